@@ -0,0 +1,947 @@
+// Package bindgen generates gx extern stubs from clang's JSON AST dump of a C++ header, the kind
+// of file otherwise written by hand with '//gx:include', '//gx:externs' and bodyless functions.
+package bindgen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Config holds options for generating stubs
+type Config struct {
+	Package string // Package name of the generated file
+	Include string // Path in '//gx:include', usually relative to an include dir
+	Header  string // Header path mentioned in the generated comment
+}
+
+// Report describes a declaration that couldn't be bound
+type Report struct {
+	File         string
+	Line, Column int
+	Message      string
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s", r.File, r.Line, r.Column, r.Message)
+}
+
+//
+// Clang AST
+//
+
+// node is a node of clang's JSON AST dump, decoding only the fields used here
+type node struct {
+	Kind               string
+	Name               string
+	Loc                *location
+	Range              *struct{ Begin, End *location }
+	Type               *cxxType
+	Inner              []*node
+	IsImplicit         bool
+	TagUsed            string
+	CompleteDefinition bool
+	StorageClass       string
+	Access             string
+	Variadic           bool
+	Constexpr          bool
+	ExplicitlyDeleted  bool
+	Opcode             string
+	Value              json.RawMessage
+
+	// Clang only writes the file and line of a location when they differ from the previous
+	// location in the dump, so these are resolved in a pass over the whole tree
+	file      string
+	line, col int
+	main      bool // Declared in the dumped header rather than one it includes
+}
+
+type location struct {
+	File         string
+	Line, Col    int
+	IncludedFrom *struct{ File string }
+	SpellingLoc  *location
+	ExpansionLoc *location
+}
+
+type cxxType struct {
+	QualType          string
+	DesugaredQualType string
+}
+
+// Dump runs clang to get the JSON AST dump of a C++ header
+func Dump(clang, header string, flags []string) ([]byte, error) {
+	args := append([]string{"-x", "c++", "-std=c++20", "-fsyntax-only", "-Xclang", "-ast-dump=json"}, flags...)
+	cmd := exec.Command(clang, append(args, header)...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	dump, err := cmd.Output()
+	if err != nil {
+		if stderr.Len() > 0 {
+			return nil, fmt.Errorf("%s: %v: %s", clang, err, strings.TrimSpace(stderr.String()))
+		}
+		return nil, fmt.Errorf("%s: %v", clang, err)
+	}
+	return dump, nil
+}
+
+// locations resolves the positions of nodes in dump order, tracking the last written file and line
+type locations struct {
+	file string
+	line int
+	main bool
+}
+
+func (l *locations) update(loc *location) {
+	if loc == nil {
+		return
+	}
+	if loc.SpellingLoc != nil || loc.ExpansionLoc != nil {
+		l.update(loc.SpellingLoc)
+		l.update(loc.ExpansionLoc) // Declarations from macros are positioned where they expand
+		return
+	}
+	if loc.File != "" {
+		l.file = loc.File
+		l.main = loc.IncludedFrom == nil
+	}
+	if loc.Line != 0 {
+		l.line = loc.Line
+	}
+}
+
+func (l *locations) resolve(n *node) {
+	l.update(n.Loc)
+	n.file, n.line, n.main = l.file, l.line, l.main
+	if loc := n.Loc; loc != nil {
+		if loc.ExpansionLoc != nil {
+			loc = loc.ExpansionLoc
+		}
+		n.col = loc.Col
+	}
+	if n.Range != nil {
+		l.update(n.Range.Begin)
+		l.update(n.Range.End)
+	}
+	for _, inner := range n.Inner {
+		if inner != nil {
+			l.resolve(inner)
+		}
+	}
+}
+
+//
+// Types
+//
+
+var goKeywords = map[string]bool{
+	"break": true, "case": true, "chan": true, "const": true, "continue": true, "default": true,
+	"defer": true, "else": true, "fallthrough": true, "for": true, "func": true, "go": true,
+	"goto": true, "if": true, "import": true, "interface": true, "map": true, "package": true,
+	"range": true, "return": true, "select": true, "struct": true, "switch": true, "type": true,
+	"var": true,
+}
+
+var basicTypes = map[string]string{
+	"bool":          "bool",
+	"int":           "int",
+	"float":         "float32",
+	"double":        "float64",
+	"unsigned char": "byte",
+}
+
+// goName returns an exported Go name for a C++ name
+func goName(name string) string {
+	if name == "" {
+		return ""
+	}
+	runes := []rune(name)
+	if unicode.IsLower(runes[0]) {
+		runes[0] = unicode.ToUpper(runes[0])
+		return string(runes)
+	} else if !unicode.IsUpper(runes[0]) {
+		return "X" + name
+	}
+	return name
+}
+
+func lowerFirst(s string) string {
+	result := []rune(s)
+	result[0] = unicode.ToLower(result[0])
+	return string(result)
+}
+
+// record is a bound C++ struct or class, or a class template
+type record struct {
+	cxxName    string // Qualified name
+	goName     string
+	typeParams []string
+	members    map[string]bool // Go names of fields and methods
+}
+
+// scope is where a type is spelled, for resolving unqualified names
+type scope struct {
+	ns         []string
+	typeParams map[string]bool
+	record     *record
+}
+
+// splitTemplateArgs splits 'A, B<C, D>' at top-level commas
+func splitTemplateArgs(args string) []string {
+	var result []string
+	depth, start := 0, 0
+	for i, ch := range args {
+		switch ch {
+		case '<', '(':
+			depth++
+		case '>', ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				result = append(result, strings.TrimSpace(args[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(result, strings.TrimSpace(args[start:]))
+}
+
+// lookup finds a record by a possibly partially qualified name as seen from a namespace
+func (g *generator) lookup(name string, ns []string) *record {
+	if strings.HasPrefix(name, "::") {
+		return g.records[strings.TrimPrefix(name, "::")]
+	}
+	for i := len(ns); i >= 0; i-- {
+		qualified := name
+		if i > 0 {
+			qualified = strings.Join(ns[:i], "::") + "::" + name
+		}
+		if rec, ok := g.records[qualified]; ok {
+			return rec
+		}
+	}
+	return nil
+}
+
+// lookupTypedef finds the Go type of a bound typedef like lookup
+func (g *generator) lookupTypedef(name string, ns []string) (string, bool) {
+	for i := len(ns); i >= 0; i-- {
+		qualified := strings.TrimPrefix(name, "::")
+		if i > 0 && !strings.HasPrefix(name, "::") {
+			qualified = strings.Join(ns[:i], "::") + "::" + name
+		}
+		if typ, ok := g.typedefs[qualified]; ok {
+			return typ, true
+		}
+	}
+	return "", false
+}
+
+// goType returns the Go type for a C++ type spelling. References are bound as values since gx
+// passes variables to extern functions as lvalues.
+func (g *generator) goType(spelling string, s scope, result bool) (string, error) {
+	typ := strings.TrimSpace(spelling)
+	typ = strings.TrimSuffix(typ, " const")
+	if typ == "const char *" {
+		return "string", nil
+	}
+	constElem := strings.HasPrefix(typ, "const ") && strings.HasSuffix(typ, "*")
+	typ = strings.TrimPrefix(typ, "const ")
+	switch {
+	case strings.HasSuffix(typ, "&&"):
+		return "", fmt.Errorf("rvalue reference '%s' not supported", spelling)
+	case strings.HasSuffix(typ, "&"):
+		return g.goType(strings.TrimSpace(strings.TrimSuffix(typ, "&")), s, result)
+	case strings.HasSuffix(typ, "*"):
+		elem := strings.TrimSpace(strings.TrimSuffix(typ, "*"))
+		if result && (constElem || strings.HasSuffix(elem, " const")) {
+			return "", fmt.Errorf("pointer to const '%s' not supported as a result", spelling)
+		}
+		goElem, err := g.goType(elem, s, result)
+		if err != nil {
+			return "", err
+		}
+		return "*" + goElem, nil
+	}
+	if basic, ok := basicTypes[typ]; ok {
+		return basic, nil
+	}
+	if s.typeParams[typ] {
+		return typ, nil
+	}
+	name, args := typ, ""
+	name = strings.TrimPrefix(name, "struct ")
+	name = strings.TrimPrefix(name, "class ")
+	if i := strings.IndexByte(name, '<'); i >= 0 && strings.HasSuffix(name, ">") {
+		name, args = name[:i], name[i+1:len(name)-1]
+	}
+	if strings.ContainsAny(name, "()[]<> ") {
+		return "", fmt.Errorf("type '%s' not supported", spelling)
+	}
+	if args == "" {
+		if typ, ok := g.lookupTypedef(name, s.ns); ok {
+			return typ, nil
+		}
+	}
+	rec := g.lookup(name, s.ns)
+	if rec == nil {
+		return "", fmt.Errorf("type '%s' not supported", spelling)
+	}
+	if len(rec.typeParams) == 0 {
+		if args != "" {
+			return "", fmt.Errorf("type '%s' not supported", spelling)
+		}
+		return rec.goName, nil
+	}
+	if args == "" {
+		if rec == s.record {
+			return rec.goName + "[" + strings.Join(rec.typeParams, ", ") + "]", nil
+		}
+		return "", fmt.Errorf("type '%s' needs template arguments", spelling)
+	}
+	var goArgs []string
+	for _, arg := range splitTemplateArgs(args) {
+		goArg, err := g.goType(arg, s, false)
+		if err != nil {
+			return "", err
+		}
+		goArgs = append(goArgs, goArg)
+	}
+	if len(goArgs) != len(rec.typeParams) {
+		return "", fmt.Errorf("type '%s' not supported", spelling)
+	}
+	return rec.goName + "[" + strings.Join(goArgs, ", ") + "]", nil
+}
+
+// recordOf returns the bound struct a type spelling names, directly or through one pointer or
+// reference
+func (g *generator) recordOf(spelling string, s scope) *record {
+	typ := strings.TrimSuffix(strings.TrimSpace(spelling), " const")
+	if strings.Count(typ, "*")+strings.Count(typ, "&") > 1 {
+		return nil
+	}
+	typ = strings.TrimSpace(strings.TrimRight(typ, "*&"))
+	typ = strings.TrimPrefix(typ, "const ")
+	typ = strings.TrimPrefix(strings.TrimPrefix(typ, "struct "), "class ")
+	return g.lookup(typ, s.ns)
+}
+
+// goTypeOf is goType of a node's type, falling back to the desugared spelling for typedefs
+func (g *generator) goTypeOf(typ *cxxType, s scope, result bool) (string, error) {
+	if typ == nil {
+		return "", fmt.Errorf("missing type")
+	}
+	goType, err := g.goType(typ.QualType, s, result)
+	if err != nil && typ.DesugaredQualType != "" {
+		if desugared, desugaredErr := g.goType(typ.DesugaredQualType, s, result); desugaredErr == nil {
+			return desugared, nil
+		}
+	}
+	return goType, err
+}
+
+// resultSpelling returns the result type of a function type spelling like 'int (float) const'
+func resultSpelling(fnType string) string {
+	if i := strings.LastIndex(fnType, ") -> "); i >= 0 {
+		return strings.TrimSpace(fnType[i+len(") -> "):])
+	}
+	depth := 0
+	for i := len(fnType) - 1; i >= 0; i-- {
+		switch fnType[i] {
+		case ')':
+			depth++
+		case '(':
+			depth--
+			if depth == 0 {
+				return strings.TrimSpace(fnType[:i])
+			}
+		}
+	}
+	return fnType
+}
+
+//
+// Generation
+//
+
+type generator struct {
+	config   Config
+	reports  []Report
+	records  map[string]*record
+	typedefs map[string]string // Go types of typedefs and aliases by qualified name
+	names    map[string]bool   // Package-level Go names
+	prefix   string            // Namespace prefix in '//gx:externs'
+	out      *strings.Builder
+}
+
+// decl is a declaration of the dumped header with its enclosing namespaces
+type decl struct {
+	node *node
+	ns   []string
+}
+
+func (g *generator) report(n *node, format string, args ...interface{}) {
+	g.reports = append(g.reports, Report{
+		File:    n.file,
+		Line:    n.line,
+		Column:  n.col,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func qualify(ns []string, name string) string {
+	if len(ns) == 0 {
+		return name
+	}
+	return strings.Join(ns, "::") + "::" + name
+}
+
+// collect lists declarations of the dumped header in namespaces or 'extern "C"' blocks
+func collect(n *node, ns []string, decls *[]decl) {
+	for _, inner := range n.Inner {
+		if inner == nil || inner.IsImplicit {
+			continue
+		}
+		switch inner.Kind {
+		case "NamespaceDecl":
+			innerNs := ns
+			if inner.Name != "" {
+				innerNs = append(append([]string{}, ns...), inner.Name)
+			}
+			collect(inner, innerNs, decls)
+		case "LinkageSpecDecl":
+			collect(inner, ns, decls)
+		default:
+			if inner.main {
+				*decls = append(*decls, decl{inner, ns})
+			}
+		}
+	}
+}
+
+// templateParams returns the type parameter names and the templated declaration of a template
+func templateParams(n *node, kind string) ([]string, *node, error) {
+	var params []string
+	for _, inner := range n.Inner {
+		switch inner.Kind {
+		case "TemplateTypeParmDecl":
+			if inner.Name == "" {
+				return nil, nil, fmt.Errorf("unnamed template parameter not supported")
+			}
+			params = append(params, inner.Name)
+		case "NonTypeTemplateParmDecl", "TemplateTemplateParmDecl":
+			return nil, nil, fmt.Errorf("template parameter '%s' not supported, only type parameters are", inner.Name)
+		case kind:
+			return params, inner, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("missing templated declaration")
+}
+
+// claim reserves a package-level Go name, reporting a conflict if it's taken
+func (g *generator) claim(n *node, cxxName, name string) bool {
+	if g.names[name] {
+		g.report(n, "%s: Go name '%s' is already used, overloads aren't supported", cxxName, name)
+		return false
+	}
+	g.names[name] = true
+	return true
+}
+
+// writeExtern writes the '//gx:extern' directive if the default name from '//gx:externs' differs
+func (g *generator) writeExtern(cxxName, name string) {
+	if g.prefix == "" || g.prefix+name != cxxName {
+		fmt.Fprintf(g.out, "//gx:extern %s\n", cxxName)
+	}
+}
+
+// signature is a bound function's parameters and result
+type signature struct {
+	params []string // 'name type'
+	names  []string
+	types  []*cxxType
+	result string
+}
+
+func (g *generator) genSignature(fn *node, s scope) (signature, error) {
+	var sig signature
+	if fn.Variadic {
+		return sig, fmt.Errorf("variadic functions not supported")
+	}
+	i := 0
+	for _, param := range fn.Inner {
+		if param.Kind != "ParmVarDecl" {
+			continue
+		}
+		typ, err := g.goTypeOf(param.Type, s, false)
+		if err != nil {
+			return sig, fmt.Errorf("parameter %d: %v", i+1, err)
+		}
+		name := param.Name
+		if name == "" {
+			name = fmt.Sprintf("arg%d", i)
+		} else if goKeywords[name] {
+			name += "_"
+		}
+		sig.params = append(sig.params, name+" "+typ)
+		sig.names = append(sig.names, name)
+		sig.types = append(sig.types, param.Type)
+		i++
+	}
+	if fn.Type == nil {
+		return sig, fmt.Errorf("missing type")
+	}
+	if resultType := resultSpelling(fn.Type.QualType); resultType != "void" {
+		var err error
+		if sig.result, err = g.goType(resultType, s, true); err != nil && fn.Type.DesugaredQualType != "" {
+			sig.result, err = g.goType(resultSpelling(fn.Type.DesugaredQualType), s, true)
+		}
+		if err != nil {
+			return sig, fmt.Errorf("result: %v", err)
+		}
+	}
+	return sig, nil
+}
+
+func (sig signature) String() string {
+	result := "(" + strings.Join(sig.params, ", ") + ")"
+	if sig.result != "" {
+		result += " " + sig.result
+	}
+	return result
+}
+
+func typeParamList(params []string) string {
+	if len(params) == 0 {
+		return ""
+	}
+	return "[" + strings.Join(params, ", ") + " any]"
+}
+
+// stubBody returns the body of a generic function, which Go requires even though gx doesn't generate
+// externs
+func stubBody(typeParams []string) string {
+	if len(typeParams) == 0 {
+		return ""
+	}
+	return " {\n\tpanic(\"extern\")\n}"
+}
+
+func typeParamSet(params []string) map[string]bool {
+	result := make(map[string]bool)
+	for _, param := range params {
+		result[param] = true
+	}
+	return result
+}
+
+// receiverName returns a receiver name for a type that doesn't collide with parameters
+func receiverName(typeName string, sig signature) string {
+	name := lowerFirst(typeName[:1])
+	for _, param := range sig.names {
+		if param == name {
+			return "self"
+		}
+	}
+	return name
+}
+
+// genRecord writes a struct with its fields, constructor and member functions
+func (g *generator) genRecord(d decl, n *node, rec *record) {
+	s := scope{ns: d.ns, typeParams: typeParamSet(rec.typeParams), record: rec}
+	typeName := rec.goName
+	if len(rec.typeParams) > 0 {
+		typeName += "[" + strings.Join(rec.typeParams, ", ") + "]"
+	}
+
+	// Fields
+	g.writeExtern(rec.cxxName, rec.goName)
+	fmt.Fprintf(g.out, "type %s%s struct {\n", rec.goName, typeParamList(rec.typeParams))
+	access := "public"
+	if n.TagUsed == "class" {
+		access = "private"
+	}
+	isPublic := func(member *node) bool {
+		if member.Access != "" {
+			return member.Access == "public"
+		}
+		return access == "public"
+	}
+	var members []*node
+	for _, member := range n.Inner {
+		if member.Kind == "AccessSpecDecl" {
+			access = member.Access
+			continue
+		}
+		if member.IsImplicit || !isPublic(member) {
+			continue
+		}
+		if member.Kind != "FieldDecl" {
+			members = append(members, member)
+			continue
+		}
+		typ, err := g.goTypeOf(member.Type, s, false)
+		if err != nil {
+			g.report(member, "field %s::%s: %v", rec.cxxName, member.Name, err)
+			continue
+		}
+		name := goName(member.Name)
+		if rec.members[name] {
+			g.report(member, "field %s::%s: Go name '%s' is already used", rec.cxxName, member.Name, name)
+			continue
+		}
+		rec.members[name] = true
+		if lowerFirst(name) != member.Name {
+			fmt.Fprintf(g.out, "\t%s %s //gx:extern %s\n", name, typ, member.Name)
+		} else {
+			fmt.Fprintf(g.out, "\t%s %s\n", name, typ)
+		}
+	}
+	g.out.WriteString("}\n\n")
+
+	// Constructor, static members and member functions
+	constructed := false
+	for _, member := range members {
+		cxxName := rec.cxxName + "::" + member.Name
+		switch member.Kind {
+		case "CXXConstructorDecl":
+			if member.ExplicitlyDeleted || g.isCopyOrMove(member, rec, s) {
+				continue // Copies don't need a function
+			}
+			sig, err := g.genSignature(member, s)
+			if err != nil {
+				g.report(member, "constructor %s: %v", cxxName, err)
+				continue
+			}
+			if len(sig.params) == 0 {
+				continue // Zero values are constructed by composite literals
+			}
+			name := "New" + rec.goName
+			if constructed || !g.claim(member, cxxName, name) {
+				if constructed {
+					g.report(member, "constructor %s: overloads aren't supported, only the first is bound", cxxName)
+				}
+				continue
+			}
+			constructed = true
+			sig.result = typeName
+			fmt.Fprintf(g.out, "//gx:extern %s\n", rec.cxxName)
+			fmt.Fprintf(g.out, "func %s%s%s%s\n\n", name, typeParamList(rec.typeParams), sig, stubBody(rec.typeParams))
+		case "CXXMethodDecl":
+			if member.ExplicitlyDeleted {
+				continue
+			}
+			if member.Name == "operator=" {
+				continue
+			} else if strings.HasPrefix(member.Name, "operator") {
+				g.report(member, "%s: operators not supported", cxxName)
+				continue
+			}
+			sig, err := g.genSignature(member, s)
+			if err != nil {
+				g.report(member, "%s: %v", cxxName, err)
+				continue
+			}
+			if member.StorageClass == "static" {
+				if len(rec.typeParams) > 0 {
+					g.report(member, "%s: static member functions of class templates not supported", cxxName)
+					continue
+				}
+				name := rec.goName + goName(member.Name)
+				if g.claim(member, cxxName, name) {
+					fmt.Fprintf(g.out, "//gx:extern %s\n", cxxName)
+					fmt.Fprintf(g.out, "func %s%s\n\n", name, sig)
+				}
+				continue
+			}
+			name := goName(member.Name)
+			if rec.members[name] {
+				g.report(member, "%s: Go name '%s' is already used, overloads aren't supported", cxxName, name)
+				continue
+			}
+			rec.members[name] = true
+			recvType := "*" + typeName
+			if member.Type != nil && strings.HasSuffix(member.Type.QualType, " const") {
+				recvType = typeName
+			}
+			fmt.Fprintf(g.out, "//gx:extern GX_METHOD(%s)\n", member.Name)
+			fmt.Fprintf(g.out, "func (%s %s) %s%s\n\n", receiverName(rec.goName, sig), recvType, name, sig)
+		case "VarDecl":
+			if len(rec.typeParams) > 0 {
+				g.report(member, "%s: static data members of class templates not supported", cxxName)
+				continue
+			}
+			g.genVar(decl{member, d.ns}, cxxName, rec.goName+goName(member.Name))
+		case "FunctionTemplateDecl":
+			g.report(member, "%s: member function templates not supported", cxxName)
+		case "CXXDestructorDecl", "UsingDecl", "FriendDecl", "StaticAssertDecl":
+		default:
+			g.report(member, "%s: %s not supported", cxxName, strings.TrimSuffix(member.Kind, "Decl"))
+		}
+	}
+}
+
+// isCopyOrMove returns whether a constructor is a copy or move constructor
+func (g *generator) isCopyOrMove(ctor *node, rec *record, s scope) bool {
+	var params []*node
+	for _, param := range ctor.Inner {
+		if param.Kind == "ParmVarDecl" {
+			params = append(params, param)
+		}
+	}
+	if len(params) != 1 || params[0].Type == nil || !strings.HasSuffix(params[0].Type.QualType, "&") {
+		return false
+	}
+	spelling := strings.TrimSuffix(params[0].Type.QualType, "&")
+	if i := strings.IndexByte(spelling, '<'); i >= 0 {
+		spelling = spelling[:i] // A class template's own instantiation
+	}
+	return g.recordOf(spelling, s) == rec
+}
+
+// literal returns the Go spelling of a constant initializer, if it's a literal
+func literal(n *node) (string, bool) {
+	switch n.Kind {
+	case "IntegerLiteral", "FloatingLiteral":
+		var value string
+		if json.Unmarshal(n.Value, &value) == nil {
+			return value, true
+		}
+	case "CXXBoolLiteralExpr":
+		var value bool
+		if json.Unmarshal(n.Value, &value) == nil {
+			return fmt.Sprint(value), true
+		}
+	case "UnaryOperator":
+		if n.Opcode == "-" && len(n.Inner) == 1 {
+			if value, ok := literal(n.Inner[0]); ok {
+				return "-" + value, true
+			}
+		}
+	case "ImplicitCastExpr", "ConstantExpr", "ParenExpr":
+		if len(n.Inner) == 1 {
+			return literal(n.Inner[0])
+		}
+	}
+	return "", false
+}
+
+// genVar writes a variable, or a constant if it's constexpr with a literal initializer
+func (g *generator) genVar(d decl, cxxName, name string) {
+	n := d.node
+	if n.Constexpr && len(n.Inner) == 1 {
+		if value, ok := literal(n.Inner[0]); ok {
+			if g.claim(n, cxxName, name) {
+				g.writeExtern(cxxName, name)
+				fmt.Fprintf(g.out, "const %s = %s\n\n", name, value)
+			}
+			return
+		}
+	}
+	typ, err := g.goTypeOf(n.Type, scope{ns: d.ns}, false)
+	if err != nil {
+		g.report(n, "%s: %v", cxxName, err)
+		return
+	}
+	if g.claim(n, cxxName, name) {
+		g.writeExtern(cxxName, name)
+		fmt.Fprintf(g.out, "var %s %s\n\n", name, typ)
+	}
+}
+
+// genFunc writes a free function, as a method if its first parameter is a bound struct
+func (g *generator) genFunc(d decl, fn *node, typeParams []string) {
+	cxxName := qualify(d.ns, fn.Name)
+	if fn.ExplicitlyDeleted {
+		return
+	}
+	if strings.HasPrefix(fn.Name, "operator") {
+		g.report(fn, "%s: operators not supported", cxxName)
+		return
+	}
+	sig, err := g.genSignature(fn, scope{ns: d.ns, typeParams: typeParamSet(typeParams)})
+	if err != nil {
+		g.report(fn, "%s: %v", cxxName, err)
+		return
+	}
+	name := goName(fn.Name)
+	if len(typeParams) == 0 && len(sig.params) > 0 {
+		recvType := strings.TrimPrefix(sig.params[0][len(sig.names[0])+1:], "*")
+		rec := g.recordOf(sig.types[0].QualType, scope{ns: d.ns})
+		if rec != nil && rec.goName == recvType && !rec.members[name] {
+			rec.members[name] = true
+			recv := sig.params[0]
+			sig.params, sig.names = sig.params[1:], sig.names[1:]
+			g.writeExtern(cxxName, name)
+			fmt.Fprintf(g.out, "func (%s) %s%s\n\n", recv, name, sig)
+			return
+		}
+	}
+	if g.claim(fn, cxxName, name) {
+		g.writeExtern(cxxName, name)
+		fmt.Fprintf(g.out, "func %s%s%s%s\n\n", name, typeParamList(typeParams), sig, stubBody(typeParams))
+	}
+}
+
+// Generate returns the Go source of stubs for declarations in the header of a clang JSON AST dump,
+// and reports of declarations that couldn't be bound
+func Generate(dump []byte, config Config) ([]byte, []Report, error) {
+	root := &node{}
+	if err := json.Unmarshal(dump, root); err != nil {
+		return nil, nil, fmt.Errorf("reading AST dump: %v", err)
+	}
+	(&locations{}).resolve(root)
+	g := &generator{
+		config:   config,
+		records:  make(map[string]*record),
+		typedefs: make(map[string]string),
+		names:    make(map[string]bool),
+		out:      &strings.Builder{},
+	}
+
+	// Collect structs first so functions can refer to ones declared later, and choose the most
+	// common namespace for '//gx:externs'
+	var decls []decl
+	collect(root, nil, &decls)
+	nsCounts := make(map[string]int)
+	for _, d := range decls {
+		n := d.node
+		switch n.Kind {
+		case "CXXRecordDecl", "ClassTemplateDecl":
+			cxxName := qualify(d.ns, n.Name)
+			if n.Name == "" || g.records[cxxName] != nil {
+				continue
+			}
+			rec := &record{cxxName: cxxName, goName: goName(n.Name), members: make(map[string]bool)}
+			if n.Kind == "ClassTemplateDecl" {
+				params, _, err := templateParams(n, "CXXRecordDecl")
+				if err != nil {
+					continue
+				}
+				rec.typeParams = params
+			} else if n.TagUsed == "union" {
+				continue
+			}
+			g.records[cxxName] = rec
+		}
+		if n.Name != "" {
+			nsCounts[strings.Join(d.ns, "::")]++
+		}
+	}
+	best := -1
+	for _, d := range decls {
+		if ns := strings.Join(d.ns, "::"); nsCounts[ns] > best {
+			best = nsCounts[ns]
+			g.prefix = ns
+		}
+	}
+	if g.prefix != "" {
+		g.prefix += "::"
+	}
+
+	// Declarations in header order
+	defined := make(map[string]bool)
+	for _, d := range decls {
+		if (d.node.Kind == "CXXRecordDecl" || d.node.Kind == "ClassTemplateDecl") && d.node.Name != "" {
+			record, pattern := d.node, d.node
+			if d.node.Kind == "ClassTemplateDecl" {
+				_, pattern, _ = templateParams(d.node, "CXXRecordDecl")
+				record = pattern
+			}
+			if record != nil && record.CompleteDefinition {
+				defined[qualify(d.ns, d.node.Name)] = true
+			}
+		}
+	}
+	generated := make(map[string]bool)
+	for _, d := range decls {
+		n := d.node
+		cxxName := qualify(d.ns, n.Name)
+		switch n.Kind {
+		case "CXXRecordDecl", "ClassTemplateDecl":
+			if n.Name == "" {
+				g.report(n, "anonymous %s not supported", n.TagUsed)
+				continue
+			}
+			pattern := n
+			if n.Kind == "ClassTemplateDecl" {
+				var err error
+				if _, pattern, err = templateParams(n, "CXXRecordDecl"); err != nil {
+					g.report(n, "%s: %v", cxxName, err)
+					continue
+				}
+			} else if n.TagUsed == "union" {
+				g.report(n, "%s: unions not supported", cxxName)
+				continue
+			}
+			rec := g.records[cxxName]
+			if generated[cxxName] || (!pattern.CompleteDefinition && defined[cxxName]) {
+				continue // Forward declarations are bound as empty structs only if not defined
+			}
+			generated[cxxName] = true
+			if g.claim(n, cxxName, rec.goName) {
+				g.genRecord(d, pattern, rec)
+			}
+		case "FunctionDecl":
+			g.genFunc(d, n, nil)
+		case "FunctionTemplateDecl":
+			params, fn, err := templateParams(n, "FunctionDecl")
+			if err != nil {
+				g.report(n, "%s: %v", cxxName, err)
+				continue
+			}
+			g.genFunc(d, fn, params)
+		case "VarDecl":
+			g.genVar(d, cxxName, goName(n.Name))
+		case "TypedefDecl", "TypeAliasDecl":
+			typ, err := g.goTypeOf(n.Type, scope{ns: d.ns}, false)
+			if err != nil {
+				g.report(n, "%s: %v", cxxName, err)
+				continue
+			}
+			g.typedefs[cxxName] = typ
+			name := goName(n.Name)
+			if name == typ {
+				continue // 'typedef struct S S;'
+			}
+			if g.claim(n, cxxName, name) {
+				fmt.Fprintf(g.out, "type %s = %s\n\n", name, typ)
+			}
+		case "EnumDecl":
+			g.report(n, "%s: enums not supported", cxxName)
+		case "UsingDirectiveDecl", "UsingDecl", "StaticAssertDecl", "EmptyDecl":
+		default:
+			g.report(n, "%s: %s not supported", cxxName, strings.TrimSuffix(n.Kind, "Decl"))
+		}
+	}
+
+	// Header
+	header := &strings.Builder{}
+	fmt.Fprintf(header, "//gx:include %s\n", quoteInclude(config.Include))
+	if g.prefix != "" {
+		fmt.Fprintf(header, "//gx:externs %s\n", g.prefix)
+	}
+	fmt.Fprintf(header, "\n// Code generated by gx bindgen from %s. DO NOT EDIT.\n\n", filepath.ToSlash(config.Header))
+	fmt.Fprintf(header, "package %s\n\n", config.Package)
+	src, err := format.Source([]byte(header.String() + g.out.String()))
+	if err != nil {
+		return nil, g.reports, fmt.Errorf("formatting generated code: %v", err)
+	}
+	return src, g.reports, nil
+}
+
+var systemIncludeRe = regexp.MustCompile(`^<.*>$`)
+
+// quoteInclude quotes an include path unless it's already in quotes or angle brackets
+func quoteInclude(include string) string {
+	if systemIncludeRe.MatchString(include) || strings.HasPrefix(include, "\"") {
+		return include
+	}
+	return "\"" + filepath.ToSlash(include) + "\""
+}
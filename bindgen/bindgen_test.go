@@ -0,0 +1,61 @@
+package bindgen
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "regenerate golden files in 'testdata'")
+
+// TestGolden generates stubs from the '.ast.json' dump of each header in 'testdata' and compares
+// them and the reports with the '.golden' files. Run with -update to regenerate them.
+func TestGolden(t *testing.T) {
+	entries, err := os.ReadDir("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		dir := filepath.Join("testdata", name)
+		t.Run(name, func(t *testing.T) {
+			dump, err := os.ReadFile(filepath.Join(dir, name+".ast.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			src, reports, err := Generate(dump, Config{Package: name, Include: name + ".hh", Header: name + ".hh"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var lines []string
+			for _, report := range reports {
+				lines = append(lines, report.String()+"\n")
+			}
+			for _, output := range []struct{ name, contents string }{
+				{name + ".gx.go.golden", string(src)},
+				{name + ".reports.golden", strings.Join(lines, "")},
+			} {
+				path := filepath.Join(dir, output.name)
+				if *update {
+					if err := os.WriteFile(path, []byte(output.contents), 0644); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				golden, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatalf("%v (run with -update to create it)", err)
+				}
+				if string(golden) != output.contents {
+					t.Errorf("%s differs from generated output (run with -update if the change is intended):\n%s",
+						path, output.contents)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+#pragma once
+
+namespace common {
+
+struct Handle {
+  int id;
+};
+
+}
@@ -0,0 +1,120 @@
+#pragma once
+
+#include "common.hh"
+
+#define SHAPES_GETTER(name) inline int name() { return 3; }
+
+namespace shapes {
+
+struct Vec2 {
+  float x, y;
+
+  float length() const {
+    return x * x + y * y;
+  }
+
+  void scale(float s) {
+    x *= s;
+    y *= s;
+  }
+
+  static Vec2 zero() {
+    return { 0, 0 };
+  }
+};
+
+inline Vec2 add(Vec2 a, Vec2 b) {
+  return { a.x + b.x, a.y + b.y };
+}
+
+inline void normalize(Vec2 *v) {
+  v->scale(1 / v->length());
+}
+
+inline float dot(const Vec2 &a, const Vec2 &b) {
+  return a.x * b.x + a.y * b.y;
+}
+
+class Counter {
+public:
+  Counter(int start)
+      : Total(start) {
+  }
+
+  int next() {
+    return ++Total;
+  }
+
+  int Total;
+
+private:
+  int count = 0;
+};
+
+inline int numShapes = 0;
+constexpr int MAX_SHAPES = 64;
+
+template<typename T>
+struct Box {
+  T value;
+
+  Box(T value_)
+      : value(value_) {
+  }
+
+  T get() const {
+    return value;
+  }
+};
+
+template<typename T>
+T largest(T a, T b) {
+  return a > b ? a : b;
+}
+
+inline int sum(const int *values, int n) {
+  int result = 0;
+  for (int i = 0; i < n; ++i) {
+    result += values[i];
+  }
+  return result;
+}
+
+inline int length(const char *s) {
+  int n = 0;
+  while (s[n]) {
+    ++n;
+  }
+  return n;
+}
+
+inline int count(const common::Handle &h) {
+  return h.id;
+}
+
+inline void printAll(const char *format, ...) {
+}
+
+enum class Color { Red, Green };
+
+inline unsigned int hash(int x) {
+  return x;
+}
+
+using Id = int;
+
+inline Id nextId(Id id) {
+  return id + 1;
+}
+
+SHAPES_GETTER(sides)
+
+namespace detail {
+
+inline int version() {
+  return 2;
+}
+
+}
+
+}
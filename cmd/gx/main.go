@@ -0,0 +1,1058 @@
+// Command gx compiles Go to C++ and builds the result with a C++ compiler
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/nikki93/gx"
+	"github.com/nikki93/gx/bindgen"
+	"github.com/nikki93/gx/gxcheck"
+	"golang.org/x/tools/go/packages"
+)
+
+//
+// Diagnostics output
+//
+
+// printDiagnostics prints errors to stdout in the given format. The 'json' format is an array of
+// Diagnostic on one line, and 'sarif' is a SARIF 2.1.0 log.
+func printDiagnostics(diagnostics []gx.Diagnostic, format string) {
+	switch format {
+	case "json":
+		if diagnostics == nil {
+			diagnostics = []gx.Diagnostic{}
+		}
+		contents, _ := json.Marshal(diagnostics)
+		fmt.Println(string(contents))
+	case "sarif":
+		rules := []interface{}{}
+		ruleAdded := make(map[string]bool)
+		results := []interface{}{}
+		for _, diagnostic := range diagnostics {
+			if !ruleAdded[diagnostic.Code] {
+				ruleAdded[diagnostic.Code] = true
+				rule := map[string]interface{}{"id": diagnostic.Code}
+				if fix, ok := gxcheck.Fixes[diagnostic.Code]; ok {
+					rule["help"] = map[string]interface{}{"text": fix}
+				}
+				rules = append(rules, rule)
+			}
+			location := map[string]interface{}{
+				"artifactLocation": map[string]interface{}{"uri": diagnostic.File},
+			}
+			if diagnostic.Line > 0 {
+				location["region"] = map[string]interface{}{
+					"startLine":   diagnostic.Line,
+					"startColumn": diagnostic.Column,
+					"endLine":     diagnostic.EndLine,
+					"endColumn":   diagnostic.EndColumn,
+				}
+			}
+			result := map[string]interface{}{
+				"ruleId":  diagnostic.Code,
+				"level":   diagnostic.Severity,
+				"message": map[string]interface{}{"text": diagnostic.Message},
+			}
+			if diagnostic.File != "" {
+				result["locations"] = []interface{}{map[string]interface{}{"physicalLocation": location}}
+			}
+			if diagnostic.SuggestedFix != "" {
+				result["properties"] = map[string]interface{}{"suggestedFix": diagnostic.SuggestedFix}
+			}
+			results = append(results, result)
+		}
+		log := map[string]interface{}{
+			"version": "2.1.0",
+			"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+			"runs": []interface{}{map[string]interface{}{
+				"tool": map[string]interface{}{"driver": map[string]interface{}{
+					"name":           "gx",
+					"version":        version,
+					"informationUri": "https://github.com/nikki93/gx",
+					"rules":          rules,
+				}},
+				"results": results,
+			}},
+		}
+		contents, _ := json.MarshalIndent(log, "", "  ")
+		fmt.Println(string(contents))
+	default:
+		for _, diagnostic := range diagnostics {
+			fmt.Println(diagnostic)
+		}
+	}
+}
+
+//
+// Watch
+//
+
+// watcher polls the files of loaded packages and included headers for changes, and updates
+// packages in place by reparsing changed ones and typechecking them along with their importers.
+// Packages that aren't affected keep their syntax and types from the previous load.
+type watcher struct {
+	fileSet     *token.FileSet
+	roots       []*packages.Package
+	pkgs        []*packages.Package // In dependency order
+	filePkgs    map[string]*packages.Package
+	dirEntries  map[string]string // Directory -> sorted names of Go files in it
+	modTimes    map[string]time.Time
+	includeDirs []string
+	loadedBase  int // Base of fileSet after the last full load
+}
+
+func goFileNames(dir string) string {
+	entries, _ := ioutil.ReadDir(dir)
+	var names []string
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasSuffix(name, ".go") && !strings.HasSuffix(name, "_test.go") {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "\n")
+}
+
+// reset starts watching the given packages from scratch
+func (w *watcher) reset(roots []*packages.Package, includeDirs []string) {
+	w.roots = roots
+	w.pkgs = nil
+	w.filePkgs = make(map[string]*packages.Package)
+	w.dirEntries = make(map[string]string)
+	w.modTimes = make(map[string]time.Time)
+	w.includeDirs = includeDirs
+	goRoot := filepath.Clean(runtime.GOROOT()) + string(filepath.Separator)
+	packages.Visit(roots, nil, func(pkg *packages.Package) {
+		w.pkgs = append(w.pkgs, pkg)
+		w.fileSet = pkg.Fset
+		for _, file := range pkg.Syntax {
+			path := pkg.Fset.Position(file.Pos()).Filename
+			if strings.HasPrefix(path, goRoot) {
+				continue
+			}
+			w.filePkgs[path] = pkg
+			if info, err := os.Stat(path); err == nil {
+				w.modTimes[path] = info.ModTime()
+			}
+			if dir := filepath.Dir(path); w.dirEntries[dir] == "" {
+				w.dirEntries[dir] = goFileNames(dir)
+			}
+		}
+	})
+	if w.fileSet != nil {
+		w.loadedBase = w.fileSet.Base()
+	}
+	for _, dir := range includeDirs {
+		entries, _ := ioutil.ReadDir(dir)
+		for _, entry := range entries {
+			switch filepath.Ext(entry.Name()) {
+			case ".h", ".hh", ".hpp":
+				w.modTimes[filepath.Join(dir, entry.Name())] = entry.ModTime()
+			}
+		}
+	}
+}
+
+// poll returns the packages with changed files and whether anything changed at all. needsLoad is
+// true if files were added or removed, which requires a full load.
+func (w *watcher) poll() (changedPkgs map[*packages.Package]bool, changed, needsLoad bool) {
+	for dir, names := range w.dirEntries {
+		if goFileNames(dir) != names {
+			return nil, true, true
+		}
+	}
+	changedPkgs = make(map[*packages.Package]bool)
+	for path, modTime := range w.modTimes {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, true, true
+		}
+		if !info.ModTime().Equal(modTime) {
+			w.modTimes[path] = info.ModTime()
+			changed = true
+			if pkg, ok := w.filePkgs[path]; ok {
+				changedPkgs[pkg] = true
+			}
+		}
+	}
+	return changedPkgs, changed, false
+}
+
+// update reparses the given packages and typechecks them and their importers. Returns false if a
+// package's imports changed, which requires a full load. A full load is also required once files
+// reparsed into the file set, which never drops old files, outgrow those loaded.
+func (w *watcher) update(changedPkgs map[*packages.Package]bool) bool {
+	if w.fileSet != nil && w.fileSet.Base() > 2*w.loadedBase {
+		return false
+	}
+
+	// Reparse
+	for pkg := range changedPkgs {
+		var syntax []*ast.File
+		var errs []packages.Error
+		imports := make(map[string]bool)
+		for _, file := range pkg.Syntax {
+			path := w.fileSet.Position(file.Pos()).Filename
+			file, err := parser.ParseFile(w.fileSet, path, nil, parser.AllErrors|parser.ParseComments)
+			if list, ok := err.(scanner.ErrorList); ok {
+				for _, err := range list {
+					errs = append(errs, packages.Error{Pos: err.Pos.String(), Msg: err.Msg, Kind: packages.ParseError})
+				}
+			} else if err != nil {
+				errs = append(errs, packages.Error{Msg: err.Error(), Kind: packages.ParseError})
+			}
+			if file == nil {
+				return false
+			}
+			for _, spec := range file.Imports {
+				path, _ := strconv.Unquote(spec.Path.Value)
+				imports[path] = true
+			}
+			syntax = append(syntax, file)
+		}
+		if len(imports) != len(pkg.Imports) {
+			return false
+		}
+		for path := range imports {
+			if _, ok := pkg.Imports[path]; !ok {
+				return false
+			}
+		}
+		pkg.Syntax = syntax
+		pkg.Errors = errs
+	}
+
+	// Typecheck changed packages and their importers, in dependency order
+	dirty := make(map[*packages.Package]bool)
+	for _, pkg := range w.pkgs {
+		dirty[pkg] = changedPkgs[pkg]
+		for _, imp := range pkg.Imports {
+			if dirty[imp] {
+				dirty[pkg] = true
+			}
+		}
+		if !dirty[pkg] {
+			continue
+		}
+		if !changedPkgs[pkg] {
+			pkg.Errors = nil
+		}
+		pkg := pkg
+		info := &types.Info{
+			Types:      make(map[ast.Expr]types.TypeAndValue),
+			Instances:  make(map[*ast.Ident]types.Instance),
+			Defs:       make(map[*ast.Ident]types.Object),
+			Uses:       make(map[*ast.Ident]types.Object),
+			Implicits:  make(map[ast.Node]types.Object),
+			Selections: make(map[*ast.SelectorExpr]*types.Selection),
+			Scopes:     make(map[ast.Node]*types.Scope),
+		}
+		config := &types.Config{
+			Importer: importerFunc(func(path string) (*types.Package, error) {
+				if imp, ok := pkg.Imports[path]; ok && imp.Types != nil {
+					return imp.Types, nil
+				}
+				return nil, fmt.Errorf("could not import %s", path)
+			}),
+			Error: func(err error) {
+				if err, ok := err.(types.Error); ok {
+					pkg.Errors = append(pkg.Errors, packages.Error{
+						Pos:  err.Fset.Position(err.Pos).String(),
+						Msg:  err.Msg,
+						Kind: packages.TypeError,
+					})
+				}
+			},
+			Sizes: pkg.TypesSizes,
+		}
+		pkg.Types, _ = config.Check(pkg.PkgPath, w.fileSet, pkg.Syntax, info)
+		pkg.TypesInfo = info
+	}
+	return true
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) {
+	return f(path)
+}
+
+// watch builds, then rebuilds whenever watched files change, until interrupted. If the packages
+// can't be loaded, it retries periodically, reporting each distinct error once.
+func watch(compileConfig gx.Config, config Config, target Target, outputPrefix string) {
+	w := &watcher{}
+	var pkgs []*packages.Package
+	var lastErr string
+	for {
+		// Compile and build
+		start := time.Now()
+		compileConfig.Packages = pkgs
+		result, err := gx.Compile(compileConfig)
+		if err != nil {
+			if err.Error() != lastErr {
+				fmt.Fprintln(os.Stderr, "gx:", err)
+			}
+			lastErr = err.Error()
+			pkgs = nil
+			time.Sleep(time.Second) // The cause may be outside watched files, such as 'go.mod'
+			continue
+		}
+		lastErr = ""
+		if pkgs == nil {
+			w.reset(result.Packages, result.IncludeDirs)
+			pkgs = result.Packages
+		}
+		if result.Errored() {
+			printDiagnostics(result.Diagnostics, config.Diagnostics)
+		} else if _, err := build(result, config, target, outputPrefix); err != nil {
+			fmt.Fprintln(os.Stderr, "gx:", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "gx: built in %v\n", time.Since(start).Round(time.Microsecond))
+		}
+		if len(result.IncludeDirs) > len(w.includeDirs) {
+			w.reset(pkgs, result.IncludeDirs) // Newly included headers
+		}
+
+		// Wait for changes
+		for {
+			time.Sleep(50 * time.Millisecond)
+			changedPkgs, changed, needsLoad := w.poll()
+			if needsLoad || (changed && !w.update(changedPkgs)) {
+				pkgs = nil
+			}
+			if changed {
+				break
+			}
+		}
+	}
+}
+
+//
+// Bindgen
+//
+
+const bindgenUsage = `usage: gx bindgen [flags] <header> [<output_file>]
+
+Generates a Go stub file declaring the structs, functions and variables of a C++ header as gx
+externs, using clang's JSON AST dump. Declarations that can't be bound are reported. The output
+file defaults to standard output.
+`
+
+// runBindgen runs the 'bindgen' command with the given arguments
+func runBindgen(args []string) {
+	flags := flag.NewFlagSet("gx bindgen", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), bindgenUsage)
+		fmt.Fprintln(flags.Output(), "\nFlags:")
+		flags.PrintDefaults()
+	}
+	clang := flags.String("clang", "clang++", "clang `path` used to dump the header's AST")
+	cxxFlags := flags.String("cxxflags", "", "additional space-separated `flags` for clang, such as include dirs")
+	astPath := flags.String("ast", "", "read the AST from a `file` made with 'clang -Xclang -ast-dump=json' instead")
+	pkgName := flags.String("package", "", "package `name` (default is the output file's dir or the header's name)")
+	include := flags.String("include", "", "`path` in '//gx:include' (default is the header path)")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	header, outputPath := flags.Arg(0), flags.Arg(1)
+
+	var dump []byte
+	var err error
+	if *astPath != "" {
+		dump, err = os.ReadFile(*astPath)
+	} else {
+		dump, err = bindgen.Dump(*clang, header, strings.Fields(*cxxFlags))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gx:", err)
+		os.Exit(1)
+	}
+	config := bindgen.Config{Package: *pkgName, Include: *include, Header: header}
+	if config.Package == "" {
+		name := strings.TrimSuffix(filepath.Base(header), filepath.Ext(header))
+		if outputPath != "" {
+			if abs, err := filepath.Abs(filepath.Dir(outputPath)); err == nil {
+				name = filepath.Base(abs)
+			}
+		}
+		config.Package = packageName(name)
+	}
+	if config.Include == "" {
+		config.Include = header
+	}
+	src, reports, err := bindgen.Generate(dump, config)
+	for _, report := range reports {
+		fmt.Fprintln(os.Stderr, report)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gx:", err)
+		os.Exit(1)
+	}
+	if outputPath == "" {
+		os.Stdout.Write(src)
+	} else if err := os.WriteFile(outputPath, src, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "gx:", err)
+		os.Exit(1)
+	}
+}
+
+// packageName returns a valid package name for a file or directory name
+func packageName(name string) string {
+	result := []rune(strings.ToLower(name))
+	for i, ch := range result {
+		if !unicode.IsLetter(ch) && !unicode.IsDigit(ch) {
+			result[i] = '_'
+		}
+	}
+	if len(result) == 0 || unicode.IsDigit(result[0]) {
+		return "_" + string(result)
+	}
+	return string(result)
+}
+
+//
+// Main
+//
+
+var version = "devel"
+
+const usage = `usage: gx <command> [flags] <main_package_path> [<output_prefix>]
+
+Commands:
+  build    generate C++ for a main package and compile it with a C++ compiler
+  run      build and run the resulting binary
+  test     build and run the TestXxx functions in '_test.gx.go' files of a package
+  watch    build, then rebuild whenever sources or included headers change
+  check    report errors without writing output
+  vet      report code gx can't compile in the given packages, without building
+  bindgen  generate a Go stub file for a C++ header, see 'gx bindgen -h'
+  version  print the gx version
+
+The output prefix defaults to '<output_dir>/<package_dir_name>', or
+'<output_dir>/<package_dir_name>.test' for test. Flag defaults are read from 'gx.json' in the
+current directory if present. Run 'gx <command> -h' for flags.
+`
+
+// Config holds settings that can be given as flags or in a 'gx.json' project config
+type Config struct {
+	OutputDir       string   `json:"outputDir"`
+	NoChecks        bool     `json:"noChecks"`
+	Target          string   `json:"target"`
+	Verbose         bool     `json:"verbose"`
+	EmitHH          bool     `json:"emitHH"`
+	Recover         bool     `json:"recover"`
+	Generate        bool     `json:"generate"`
+	CXX             string   `json:"cxx"`
+	CXXFlags        []string `json:"cxxFlags"`
+	Opt             string   `json:"opt"`
+	Binary          string   `json:"binary"`
+	LineDirectives  bool     `json:"lineDirectives"`
+	Separate        bool     `json:"separate"`
+	CompileCommands bool     `json:"compileCommands"`
+	Diagnostics     string   `json:"diagnostics"`
+	CacheDir        string   `json:"cacheDir"`
+	KeepAll         bool     `json:"keepAll"`
+}
+
+// Target describes a platform profile generated code is built for
+type Target struct {
+	exceptions   bool
+	cxx          string
+	cxxFlags     []string
+	binarySuffix string
+	runner       []string
+}
+
+var targets = map[string]Target{
+	"desktop": {
+		exceptions: true,
+		cxx:        "clang++",
+	},
+	"web": {
+		exceptions:   false,
+		cxx:          "em++",
+		cxxFlags:     []string{"-fno-exceptions"},
+		binarySuffix: ".js",
+		runner:       []string{"node"},
+	},
+}
+
+func loadConfig(path string) (Config, error) {
+	config := Config{
+		OutputDir:   "build",
+		Target:      "desktop",
+		EmitHH:      true,
+		Opt:         "0",
+		Diagnostics: "text",
+	}
+	if contents, err := ioutil.ReadFile(path); err == nil {
+		if err := json.Unmarshal(contents, &config); err != nil {
+			return config, fmt.Errorf("%s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return config, err
+	}
+	return config, nil
+}
+
+func readersEqual(a, b io.Reader) bool {
+	bufA := make([]byte, 1024)
+	bufB := make([]byte, 1024)
+	for {
+		nA, errA := io.ReadFull(a, bufA)
+		nB, _ := io.ReadFull(b, bufB)
+		if !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return false
+		}
+		if errA == io.EOF {
+			return true
+		}
+	}
+}
+
+func writeFileIfChanged(path string, contents string) bool {
+	byteContents := []byte(contents)
+	if f, err := os.Open(path); err == nil {
+		defer f.Close()
+		if readersEqual(f, bytes.NewReader(byteContents)) {
+			return false
+		}
+	}
+	ioutil.WriteFile(path, byteContents, 0644)
+	return true
+}
+
+// headersNewerThan reports whether any header file in the given directories was modified after a time
+func headersNewerThan(dirs []string, t time.Time) bool {
+	for _, dir := range dirs {
+		entries, _ := ioutil.ReadDir(dir)
+		for _, entry := range entries {
+			switch filepath.Ext(entry.Name()) {
+			case ".h", ".hh", ".hpp":
+				if entry.ModTime().After(t) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func logTime(config Config, phase string, start time.Time) {
+	if config.Verbose {
+		fmt.Fprintf(os.Stderr, "gx: %s took %v\n", phase, time.Since(start).Round(time.Microsecond))
+	}
+}
+
+var cxxDiagnosticRe = regexp.MustCompile(`^(.*\.gx\.(?:cc|hh)):(\d+):(\d+): (.*)$`)
+
+// runCXX runs the C++ compiler, rewriting diagnostics about generated code to point at the Go
+// code that generated it. files maps paths of generated files to the files.
+func runCXX(result *gx.Result, cxx string, args []string, files map[string]*gx.File) error {
+	cmd := exec.Command(cxx, args...)
+	cmd.Stdout = os.Stdout
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stderr)
+	scanner.Buffer(nil, 16<<20) // Template errors can make very long lines
+	for scanner.Scan() {
+		line := scanner.Text()
+		if matches := cxxDiagnosticRe.FindStringSubmatch(line); matches != nil {
+			ccLine, _ := strconv.Atoi(matches[2])
+			if file, ok := files[filepath.Clean(matches[1])]; ok {
+				if position, ok := result.GoPosition(file, ccLine); ok {
+					line = fmt.Sprintf("%s: %s [%s:%s:%s]", position, matches[4], matches[1], matches[2], matches[3])
+				}
+			}
+		}
+		fmt.Fprintln(os.Stderr, line)
+	}
+	scanErr := scanner.Err()
+	if scanErr != nil {
+		io.Copy(os.Stderr, stderr) // Pass the rest through so the compiler isn't blocked writing it
+	}
+	if err := cmd.Wait(); err != nil {
+		return err
+	}
+	if scanErr != nil {
+		return fmt.Errorf("reading C++ compiler output: %v", scanErr)
+	}
+	return nil
+}
+
+// build writes compiler output and compiles it with the C++ compiler unless only generating,
+// skipping the C++ step if the output, command and headers are unchanged since the last build.
+// The binary is removed if compiling fails, so the next build doesn't skip to the stale one.
+// Returns the path of the binary.
+func build(result *gx.Result, config Config, target Target, outputPrefix string) (string, error) {
+	if config.Separate {
+		return buildUnits(result, config, target, outputPrefix)
+	}
+
+	// Write output
+	writeStart := time.Now()
+	os.MkdirAll(filepath.Dir(outputPrefix), 0755)
+	changed := writeFileIfChanged(filepath.Dir(outputPrefix)+"/gx.hh", gx.RuntimeHeader)
+	ccPath := outputPrefix + ".gx.cc"
+	if writeFileIfChanged(ccPath, result.CC.Contents) {
+		changed = true
+	}
+	if config.EmitHH {
+		writeFileIfChanged(outputPrefix+".gx.hh", result.HH.Contents)
+	}
+	if result.H != nil {
+		writeFileIfChanged(outputPrefix+".gx.h", result.H.Contents)
+	}
+	cxx, binary := cxxAndBinary(config, target, outputPrefix)
+	cxxArgs := cxxArgs(result, config, target)
+	writeDepfile(result, outputPrefix+".gx.d", []string{ccPath})
+	if config.CompileCommands {
+		if err := writeCompileCommands(filepath.Dir(outputPrefix), cxx, cxxArgs, []string{ccPath}); err != nil {
+			return "", err
+		}
+	}
+	logTime(config, "writing output", writeStart)
+	if config.Generate {
+		return "", nil
+	}
+
+	// Compile C++
+	cxxArgs = append(cxxArgs, "-o", binary, ccPath)
+	if writeFileIfChanged(outputPrefix+".gx.cmd", cxx+" "+strings.Join(cxxArgs, " ")+"\n") {
+		changed = true
+	}
+	if info, err := os.Stat(binary); changed || err != nil || headersNewerThan(result.IncludeDirs, info.ModTime()) {
+		cxxStart := time.Now()
+		if err := runCXX(result, cxx, cxxArgs, map[string]*gx.File{filepath.Clean(ccPath): result.CC}); err != nil {
+			os.Remove(binary)
+			return "", fmt.Errorf("%s: %v", cxx, err)
+		}
+		logTime(config, "compiling C++", cxxStart)
+	} else if config.Verbose {
+		fmt.Fprintln(os.Stderr, "gx: C++ output unchanged, skipping compilation")
+	}
+	return binary, nil
+}
+
+// writeDepfile writes a Makefile-style depfile listing the Go files and headers the given
+// generated files were made from
+func writeDepfile(result *gx.Result, path string, targets []string) {
+	escape := strings.NewReplacer(" ", "\\ ", "#", "\\#", "$", "$$")
+	builder := &strings.Builder{}
+	for i, target := range targets {
+		if i > 0 {
+			builder.WriteString(" ")
+		}
+		builder.WriteString(escape.Replace(target))
+	}
+	builder.WriteString(":")
+	for _, input := range result.InputFiles {
+		builder.WriteString(" \\\n  ")
+		builder.WriteString(escape.Replace(input))
+	}
+	builder.WriteString("\n")
+	writeFileIfChanged(path, builder.String())
+}
+
+// compileCommand is an entry of a 'compile_commands.json' compilation database
+type compileCommand struct {
+	Directory string   `json:"directory"`
+	Arguments []string `json:"arguments"`
+	File      string   `json:"file"`
+}
+
+// writeCompileCommands adds entries for generated files to 'compile_commands.json' in the output
+// dir, keeping entries for other files so multiple programs can share the dir
+func writeCompileCommands(outputDir string, cxx string, cxxArgs []string, ccPaths []string) error {
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(outputDir, "compile_commands.json")
+	var commands []compileCommand
+	if contents, err := ioutil.ReadFile(path); err == nil {
+		json.Unmarshal(contents, &commands)
+	}
+	for _, ccPath := range ccPaths {
+		absPath, err := filepath.Abs(ccPath)
+		if err != nil {
+			return err
+		}
+		command := compileCommand{
+			Directory: dir,
+			Arguments: append(append([]string{cxx}, cxxArgs...), "-c", absPath),
+			File:      absPath,
+		}
+		found := false
+		for i := range commands {
+			if commands[i].File == absPath {
+				commands[i] = command
+				found = true
+			}
+		}
+		if !found {
+			commands = append(commands, command)
+		}
+	}
+	contents, err := json.MarshalIndent(commands, "", "  ")
+	if err != nil {
+		return err
+	}
+	writeFileIfChanged(path, string(contents)+"\n")
+	return nil
+}
+
+func cxxAndBinary(config Config, target Target, outputPrefix string) (string, string) {
+	cxx := config.CXX
+	if cxx == "" {
+		cxx = os.Getenv("CXX")
+	}
+	if cxx == "" {
+		cxx = target.cxx
+	}
+	binary := config.Binary
+	if binary == "" {
+		binary = outputPrefix + target.binarySuffix
+	}
+	return cxx, binary
+}
+
+func cxxArgs(result *gx.Result, config Config, target Target) []string {
+	cxxArgs := []string{"-std=c++20", "-Wall", "-O" + config.Opt}
+	cxxArgs = append(cxxArgs, target.cxxFlags...)
+	for _, dir := range result.IncludeDirs {
+		cxxArgs = append(cxxArgs, "-I"+dir)
+	}
+	return append(cxxArgs, config.CXXFlags...)
+}
+
+// buildUnits is build for separate compilation units. It writes a make-style manifest of the
+// units' dependencies, compiles each unit whose source or headers changed to an object file and
+// links them. Like the binary, objects are removed if compiling them fails.
+func buildUnits(result *gx.Result, config Config, target Target, outputPrefix string) (string, error) {
+	// Write output
+	writeStart := time.Now()
+	outputDir := filepath.Dir(outputPrefix)
+	os.MkdirAll(outputDir, 0755)
+	gxHHPath := filepath.Join(outputDir, "gx.hh")
+	writeFileIfChanged(gxHHPath, gx.RuntimeHeader)
+	files := make(map[string]*gx.File)
+	for _, u := range result.Units {
+		ccPath := filepath.Join(outputDir, u.CC.Name)
+		hhPath := filepath.Join(outputDir, u.HH.Name)
+		writeFileIfChanged(ccPath, u.CC.Contents)
+		writeFileIfChanged(hhPath, u.HH.Contents)
+		files[filepath.Clean(ccPath)] = u.CC
+		files[filepath.Clean(hhPath)] = u.HH
+	}
+	if result.H != nil {
+		writeFileIfChanged(filepath.Join(outputDir, result.H.Name), result.H.Contents)
+	}
+
+	// Write manifest. Each object depends on its unit's source, its header and transitively on
+	// the headers of imported units.
+	cxx, binary := cxxAndBinary(config, target, outputPrefix)
+	cxxArgs := cxxArgs(result, config, target)
+	objPath := func(u *gx.Unit) string {
+		return filepath.Join(outputDir, strings.TrimSuffix(u.CC.Name, ".gx.cc")+".o")
+	}
+	unitDeps := make(map[*gx.Unit][]string)
+	var addDeps func(u *gx.Unit, deps []string, visited map[*gx.Unit]bool) []string
+	addDeps = func(u *gx.Unit, deps []string, visited map[*gx.Unit]bool) []string {
+		if visited[u] {
+			return deps
+		}
+		visited[u] = true
+		deps = append(deps, filepath.Join(outputDir, u.HH.Name))
+		for _, imp := range u.Imports {
+			deps = addDeps(imp, deps, visited)
+		}
+		return deps
+	}
+	manifest := &strings.Builder{}
+	manifest.WriteString("# Generated by gx, don't edit\n\n")
+	manifest.WriteString("GX_CXX = " + cxx + "\n")
+	manifest.WriteString("GX_CXXFLAGS = " + strings.Join(cxxArgs, " ") + "\n")
+	manifest.WriteString("GX_UNITS =")
+	for _, u := range result.Units {
+		manifest.WriteString(" " + objPath(u))
+	}
+	manifest.WriteString("\n\n")
+	manifest.WriteString(binary + ": $(GX_UNITS)\n")
+	manifest.WriteString("\t$(GX_CXX) $(GX_CXXFLAGS) -o $@ $^\n")
+	for _, u := range result.Units {
+		deps := []string{filepath.Join(outputDir, u.CC.Name)}
+		deps = addDeps(u, deps, make(map[*gx.Unit]bool))
+		deps = append(deps, gxHHPath)
+		unitDeps[u] = deps
+		manifest.WriteString("\n" + objPath(u) + ":")
+		for _, dep := range deps {
+			manifest.WriteString(" " + dep)
+		}
+		manifest.WriteString("\n\t$(GX_CXX) $(GX_CXXFLAGS) -c -o $@ $<\n")
+	}
+	manifestChanged := writeFileIfChanged(outputPrefix+".gx.mk", manifest.String())
+	var ccPaths []string
+	for _, u := range result.Units {
+		ccPaths = append(ccPaths, filepath.Join(outputDir, u.CC.Name))
+	}
+	writeDepfile(result, outputPrefix+".gx.d", ccPaths)
+	if config.CompileCommands {
+		if err := writeCompileCommands(outputDir, cxx, cxxArgs, ccPaths); err != nil {
+			return "", err
+		}
+	}
+	logTime(config, "writing output", writeStart)
+	if config.Generate {
+		return "", nil
+	}
+
+	// Compile units whose dependencies are newer than their objects. A dependency written in the same
+	// tick of the file system's clock as an object counts as newer, since that could be a rewrite
+	// right after compiling.
+	cxxStart := time.Now()
+	linkNeeded := manifestChanged
+	var objs []string
+	for _, u := range result.Units {
+		obj := objPath(u)
+		objs = append(objs, obj)
+		stale := manifestChanged
+		if info, err := os.Stat(obj); err != nil || headersNewerThan(result.IncludeDirs, info.ModTime()) {
+			stale = true
+		} else {
+			for _, dep := range unitDeps[u] {
+				if depInfo, err := os.Stat(dep); err != nil || !depInfo.ModTime().Before(info.ModTime()) {
+					stale = true
+					break
+				}
+			}
+		}
+		if stale {
+			args := append(append([]string{}, cxxArgs...), "-c", "-o", obj, unitDeps[u][0])
+			if err := runCXX(result, cxx, args, files); err != nil {
+				os.Remove(obj)
+				return "", fmt.Errorf("%s: %v", cxx, err)
+			}
+			linkNeeded = true
+		}
+	}
+
+	// Link
+	if _, err := os.Stat(binary); linkNeeded || err != nil {
+		args := append(append([]string{}, cxxArgs...), "-o", binary)
+		if err := runCXX(result, cxx, append(args, objs...), files); err != nil {
+			os.Remove(binary)
+			return "", fmt.Errorf("%s: %v", cxx, err)
+		}
+		logTime(config, "compiling C++", cxxStart)
+	} else if config.Verbose {
+		fmt.Fprintln(os.Stderr, "gx: C++ output unchanged, skipping compilation")
+	}
+	return binary, nil
+}
+
+func main() {
+	// Command
+	args := os.Args[1:]
+	command := "build"
+	if len(args) > 0 {
+		switch args[0] {
+		case "build", "run", "test", "check", "watch", "vet":
+			command = args[0]
+			args = args[1:]
+		case "bindgen":
+			runBindgen(args[1:])
+			return
+		case "version":
+			fmt.Printf("gx version %s %s\n", version, runtime.Version())
+			return
+		case "help", "-h", "-help", "--help":
+			fmt.Print(usage)
+			return
+		}
+	}
+
+	// Flags, with defaults from the project config
+	config, err := loadConfig("gx.json")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	flags := flag.NewFlagSet("gx "+command, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		fmt.Fprintln(flags.Output(), "\nFlags:")
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&config.OutputDir, "out", config.OutputDir, "output `dir` used when no output prefix is given")
+	flags.BoolVar(&config.NoChecks, "no-checks", config.NoChecks, "disable runtime bounds and nil checks")
+	flags.StringVar(&config.Target, "target", config.Target, "target `profile` (desktop or web)")
+	flags.BoolVar(&config.Verbose, "v", config.Verbose, "print timings of each step")
+	flags.BoolVar(&config.EmitHH, "hh", config.EmitHH, "emit a '.gx.hh' header for exported declarations")
+	flags.BoolVar(&config.Recover, "recover", config.Recover, "support recover using C++ exceptions")
+	flags.BoolVar(&config.Generate, "generate", config.Generate, "only generate C++, don't compile it")
+	flags.StringVar(&config.CXX, "cxx", config.CXX, "C++ compiler `path` (default depends on target, or $CXX)")
+	cxxFlags := flags.String("cxxflags", "", "additional space-separated `flags` for the C++ compiler")
+	flags.StringVar(&config.Opt, "O", config.Opt, "C++ optimization `level`")
+	flags.StringVar(&config.Binary, "binary", config.Binary, "output binary `path` (default is the output prefix)")
+	flags.BoolVar(&config.LineDirectives, "line", config.LineDirectives, "emit #line directives pointing at Go source")
+	flags.BoolVar(&config.Separate, "separate", config.Separate, "emit and compile a separate unit per package")
+	flags.StringVar(&config.Diagnostics, "diagnostics", config.Diagnostics, "error output `format` (text, json or sarif)")
+	flags.BoolVar(&config.CompileCommands, "compile-commands", config.CompileCommands, "write 'compile_commands.json' for generated code in the output dir")
+	flags.StringVar(&config.CacheDir, "cache", config.CacheDir, "`dir` caching generated code of unchanged packages, disabled if empty")
+	flags.BoolVar(&config.KeepAll, "keep-all", config.KeepAll, "keep declarations unreachable from main, tests and exports")
+	jobs := flags.Int("j", 0, "number of function bodies to generate concurrently (default GOMAXPROCS)")
+	checkDeterminism := flags.Bool("check-determinism", false, "compile twice and fail if the generated C++ differs")
+	runPattern := flags.String("run", "", "only run tests matching `regexp`, with subtests matched after '/' (test only)")
+	flags.Parse(args)
+	config.CXXFlags = append(config.CXXFlags, strings.Fields(*cxxFlags)...)
+	if flags.NArg() < 1 || (flags.NArg() > 2 && command != "vet") {
+		flags.Usage()
+		os.Exit(2)
+	}
+	switch config.Diagnostics {
+	case "text", "json", "sarif":
+	default:
+		fmt.Fprintf(os.Stderr, "gx: unknown diagnostics format '%s'\n", config.Diagnostics)
+		os.Exit(2)
+	}
+	if command == "vet" {
+		diagnostics, err := gx.Vet(nil, flags.Args()...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "gx:", err)
+			os.Exit(1)
+		}
+		if config.Diagnostics != "text" || len(diagnostics) > 0 {
+			printDiagnostics(diagnostics, config.Diagnostics)
+		}
+		if len(diagnostics) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	target, ok := targets[config.Target]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "gx: unknown target '%s'\n", config.Target)
+		os.Exit(2)
+	}
+	if config.Recover && !target.exceptions {
+		fmt.Fprintf(os.Stderr, "gx: target '%s' doesn't support exceptions, needed by -recover\n", config.Target)
+		os.Exit(2)
+	}
+	if command == "test" && !target.exceptions {
+		fmt.Fprintf(os.Stderr, "gx: target '%s' doesn't support exceptions, needed by test\n", config.Target)
+		os.Exit(2)
+	}
+	mainPkgPath := flags.Arg(0)
+	outputPrefix := flags.Arg(1)
+	if outputPrefix == "" {
+		name := filepath.Base(mainPkgPath)
+		if abs, err := filepath.Abs(mainPkgPath); err == nil {
+			name = filepath.Base(abs)
+		}
+		if command == "test" {
+			name += ".test"
+		}
+		outputPrefix = filepath.Join(config.OutputDir, name)
+	}
+
+	// Compile
+	compileConfig := gx.Config{
+		MainPkgPath:      mainPkgPath,
+		Recover:          config.Recover,
+		NoChecks:         config.NoChecks,
+		LineDirectives:   config.LineDirectives,
+		Separate:         config.Separate,
+		Test:             command == "test",
+		OutputName:       filepath.Base(outputPrefix),
+		CheckDeterminism: *checkDeterminism,
+		CacheDir:         config.CacheDir,
+		Jobs:             *jobs,
+		KeepAll:          config.KeepAll,
+	}
+	if config.Verbose {
+		compileConfig.Log = os.Stderr
+	}
+	if command == "watch" {
+		watch(compileConfig, config, target, outputPrefix)
+		return
+	}
+	result, err := gx.Compile(compileConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gx:", err)
+		os.Exit(1)
+	}
+	if config.Diagnostics != "text" || result.Errored() {
+		printDiagnostics(result.Diagnostics, config.Diagnostics)
+	}
+	if result.Errored() {
+		os.Exit(1)
+	}
+	if config.Verbose {
+		for _, removed := range result.Removed {
+			fmt.Fprintf(os.Stderr, "gx: removed unreachable %s\n", removed)
+		}
+	}
+	if command == "check" {
+		return
+	}
+
+	// Build
+	binary, err := build(result, config, target, outputPrefix)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gx:", err)
+		os.Exit(1)
+	}
+	if command == "build" || config.Generate {
+		return
+	}
+
+	// Run
+	runArgs := append(append([]string{}, target.runner...), binary)
+	if len(target.runner) == 0 && !filepath.IsAbs(binary) {
+		runArgs[0] = "." + string(filepath.Separator) + binary
+	}
+	if command == "test" {
+		if config.Verbose {
+			runArgs = append(runArgs, "-v")
+		}
+		if *runPattern != "" {
+			runArgs = append(runArgs, "-run", *runPattern)
+		}
+	}
+	runCmd := exec.Command(runArgs[0], runArgs[1:]...)
+	runCmd.Stdin, runCmd.Stdout, runCmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := runCmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		fmt.Fprintln(os.Stderr, "gx:", err)
+		os.Exit(1)
+	}
+}
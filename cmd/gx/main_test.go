@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nikki93/gx"
+	"golang.org/x/tools/go/packages"
+)
+
+// TestBuildRetriesFailedCompile builds with a stand-in C++ compiler, makes it fail on changed
+// output and checks that building again retries compiling rather than keeping the old binary
+func TestBuildRetriesFailedCompile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stand-in compiler is a shell script")
+	}
+	dir := t.TempDir()
+	cxx := filepath.Join(dir, "cxx")
+	writeCXX := func(script string) {
+		if err := os.WriteFile(cxx, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, separate := range []bool{false, true} {
+		outputPrefix := filepath.Join(dir, "out", "main")
+		if separate {
+			outputPrefix = filepath.Join(dir, "out-separate", "main")
+		}
+		config := Config{CXX: cxx, Separate: separate}
+		result := func(contents string) *gx.Result {
+			result := &gx.Result{CC: &gx.File{Name: "main.gx.cc", Contents: contents}}
+			if separate {
+				result.HH = &gx.File{Name: "main.gx.hh"}
+				result.Units = []*gx.Unit{{PkgPath: "main", CC: result.CC, HH: result.HH}}
+			}
+			return result
+		}
+		// Writes the argument after '-o'
+		writeCXX(`while [ "$1" != "-o" ]; do shift; done; echo built > "$2"` + "\n")
+		if _, err := build(result("int main() {}\n"), config, targets["desktop"], outputPrefix); err != nil {
+			t.Fatalf("separate=%v: %v", separate, err)
+		}
+		writeCXX("exit 1\n")
+		for i := 0; i < 2; i++ {
+			if _, err := build(result("int main() { return 1; }\n"), config, targets["desktop"], outputPrefix); err == nil {
+				t.Fatalf("separate=%v: build %d after a failed compile kept the old binary", separate, i+1)
+			}
+		}
+	}
+}
+
+// TestDepfileTargets checks that the depfile of separate units names the units' generated sources
+func TestDepfileTargets(t *testing.T) {
+	dir := t.TempDir()
+	outputPrefix := filepath.Join(dir, "main")
+	var units []*gx.Unit
+	for _, name := range []string{"main", "main.foo"} {
+		units = append(units, &gx.Unit{
+			CC: &gx.File{Name: name + ".gx.cc"},
+			HH: &gx.File{Name: name + ".gx.hh"},
+		})
+	}
+	result := &gx.Result{CC: units[0].CC, HH: units[0].HH, Units: units, InputFiles: []string{"main.gx.go"}}
+	config := Config{Separate: true, Generate: true}
+	if _, err := build(result, config, targets["desktop"], outputPrefix); err != nil {
+		t.Fatal(err)
+	}
+	depfile, err := os.ReadFile(outputPrefix + ".gx.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(dir, "main.gx.cc") + " " + filepath.Join(dir, "main.foo.gx.cc") + ": \\\n  main.gx.go\n"
+	if string(depfile) != want {
+		t.Errorf("depfile is %q, want %q", depfile, want)
+	}
+}
+
+// TestRunCXXLongLines runs a stand-in compiler that writes lines longer than the scanner's limits to
+// stderr, which must neither stop the output from being read nor hang waiting for the compiler
+func TestRunCXXLongLines(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stand-in compiler is a shell script")
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	stderr := os.Stderr
+	os.Stderr = devNull
+	defer func() { os.Stderr = stderr }()
+
+	dir := t.TempDir()
+	cxx := filepath.Join(dir, "cxx")
+	for _, test := range []struct {
+		size int
+		fail bool
+	}{{1 << 20, false}, {20 << 20, true}} {
+		script := "#!/bin/sh\nhead -c " + strconv.Itoa(test.size) + " /dev/zero | tr '\\0' x >&2\necho >&2\necho done >&2\n"
+		if err := os.WriteFile(cxx, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- runCXX(&gx.Result{}, cxx, nil, nil)
+		}()
+		select {
+		case err := <-done:
+			if fail := err != nil; fail != test.fail {
+				t.Errorf("line of %d bytes: error %v", test.size, err)
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatalf("line of %d bytes: hung waiting for the compiler", test.size)
+		}
+	}
+}
+
+// TestWatcherFileSetBounded reparses a package repeatedly and checks that the watcher asks for a
+// full load, which starts a new file set, before the file set grows without bound
+func TestWatcherFileSetBounded(t *testing.T) {
+	result, err := gx.Compile(gx.Config{MainPkgPath: "../../example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &watcher{}
+	w.reset(result.Packages, result.IncludeDirs)
+	for i := 0; ; i++ {
+		if i == 100 {
+			t.Fatalf("file set grew from %d to %d without a full load", w.loadedBase, w.fileSet.Base())
+		}
+		if !w.update(map[*packages.Package]bool{result.Packages[0]: true}) {
+			break
+		}
+	}
+}
@@ -0,0 +1,389 @@
+// Command gxdiff checks that programs behave the same when compiled with gx as under the Go
+// toolchain. Each program is built with 'go build' and with gx and a C++ compiler, then the
+// combined stdout and stderr and the exit status of both binaries are compared.
+//
+// Go can't build externs, so bodyless functions are given bodies that panic for the Go build.
+// Functions that rely on C++ behavior on purpose, such as through externs or 'default' tags, can
+// be skipped by both builds with a '//gxdiff:skip' comment, which makes them return immediately.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nikki93/gx"
+	"golang.org/x/tools/go/packages"
+)
+
+//
+// Overlays
+//
+
+// rewrite returns the source of a '.gx.go' file with '//gxdiff:skip' functions returning early
+// and, if stubExterns is set, bodyless functions given bodies that panic. ok is false if nothing
+// changed.
+func rewrite(fileSet *token.FileSet, path string, stubExterns bool) ([]byte, bool, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	file, err := parser.ParseFile(fileSet, path, src, parser.ParseComments)
+	if err != nil {
+		return nil, false, err
+	}
+	type edit struct {
+		start, end  int
+		replacement string
+	}
+	var edits []edit
+	for _, decl := range file.Decls {
+		funcDecl, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		skip := false
+		if funcDecl.Doc != nil {
+			for _, comment := range funcDecl.Doc.List {
+				if strings.HasPrefix(comment.Text, "//gxdiff:skip") {
+					skip = true
+				}
+			}
+		}
+		if skip && funcDecl.Body != nil {
+			// Return early rather than removing the body, so imports stay used
+			start := fileSet.Position(funcDecl.Body.Lbrace).Offset + 1
+			if funcDecl.Type.Results != nil {
+				edits = append(edits, edit{start, start, " panic(\"gxdiff: skipped\");"})
+			} else {
+				edits = append(edits, edit{start, start, " return;"})
+			}
+		} else if stubExterns && funcDecl.Body == nil {
+			end := fileSet.Position(funcDecl.End()).Offset
+			edits = append(edits, edit{end, end, " { panic(\"gxdiff: extern\") }"})
+		}
+	}
+	if len(edits) == 0 {
+		return nil, false, nil
+	}
+	sort.Slice(edits, func(i, j int) bool {
+		return edits[i].start > edits[j].start
+	})
+	for _, e := range edits {
+		src = append(src[:e.start:e.start], append([]byte(e.replacement), src[e.end:]...)...)
+	}
+	return src, true, nil
+}
+
+// overlays returns the rewritten '.gx.go' files of a program and its dependencies for the gx and
+// Go builds, keyed by absolute path, and whether the program calls 'recover' so gx needs -recover
+func overlays(dir string) (gxOverlay, goOverlay map[string][]byte, recovers bool, err error) {
+	pkgs, err := packages.Load(&packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps,
+	}, dir)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	gxOverlay = make(map[string][]byte)
+	goOverlay = make(map[string][]byte)
+	fileSet := token.NewFileSet()
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		for _, path := range pkg.GoFiles {
+			if err != nil || !strings.HasSuffix(path, ".gx.go") {
+				continue
+			}
+			var src []byte
+			var ok bool
+			if src, ok, err = rewrite(fileSet, path, false); ok {
+				gxOverlay[path] = src
+			}
+			if err == nil {
+				if src, ok, err = rewrite(fileSet, path, true); ok {
+					goOverlay[path] = src
+				}
+			}
+			if err == nil && !recovers {
+				recovers, err = callsRecover(fileSet, path)
+			}
+		}
+	})
+	return gxOverlay, goOverlay, recovers, err
+}
+
+// callsRecover returns whether a file calls the 'recover' builtin
+func callsRecover(fileSet *token.FileSet, path string) (bool, error) {
+	file, err := parser.ParseFile(fileSet, path, nil, 0)
+	if err != nil {
+		return false, err
+	}
+	result := false
+	ast.Inspect(file, func(node ast.Node) bool {
+		if call, ok := node.(*ast.CallExpr); ok {
+			if ident, ok := call.Fun.(*ast.Ident); ok && ident.Name == "recover" && len(call.Args) == 0 {
+				result = true
+			}
+		}
+		return !result
+	})
+	return result, nil
+}
+
+// writeGoOverlay writes overlay files and the JSON description 'go build -overlay' expects to dir
+func writeGoOverlay(overlay map[string][]byte, dir string) (string, error) {
+	replace := make(map[string]string)
+	var paths []string
+	for path := range overlay {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for i, path := range paths {
+		overlayPath := filepath.Join(dir, fmt.Sprintf("%d.%s", i, filepath.Base(path)))
+		if err := os.WriteFile(overlayPath, overlay[path], 0644); err != nil {
+			return "", err
+		}
+		replace[path] = overlayPath
+	}
+	data, err := json.Marshal(struct{ Replace map[string]string }{replace})
+	if err != nil {
+		return "", err
+	}
+	jsonPath := filepath.Join(dir, "overlay.json")
+	return jsonPath, os.WriteFile(jsonPath, data, 0644)
+}
+
+//
+// Build
+//
+
+func buildGo(goCmd, dir, outputDir string, overlay map[string][]byte) (string, error) {
+	binary := filepath.Join(outputDir, "go.bin")
+	args := []string{"build", "-o", binary}
+	if len(overlay) > 0 {
+		overlayDir := filepath.Join(outputDir, "overlay")
+		os.MkdirAll(overlayDir, 0755)
+		jsonPath, err := writeGoOverlay(overlay, overlayDir)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "-overlay", jsonPath)
+	}
+	args = append(args, dir)
+	if output, err := exec.Command(goCmd, args...).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("go build failed: %v\n%s", err, output)
+	}
+	return binary, nil
+}
+
+func buildGX(cxx, dir, outputDir string, overlay map[string][]byte, recover bool) (string, error) {
+	result, err := gx.Compile(gx.Config{
+		MainPkgPath:    dir,
+		PackagesConfig: &packages.Config{Overlay: overlay},
+		OutputName:     "main",
+		Recover:        recover,
+	})
+	if err != nil {
+		return "", err
+	}
+	if result.Errored() {
+		var messages []string
+		for _, diagnostic := range result.Diagnostics {
+			messages = append(messages, diagnostic.String())
+		}
+		return "", fmt.Errorf("gx failed:\n%s", strings.Join(messages, "\n"))
+	}
+	ccPath := filepath.Join(outputDir, result.CC.Name)
+	os.WriteFile(filepath.Join(outputDir, "gx.hh"), []byte(gx.RuntimeHeader), 0644)
+	os.WriteFile(ccPath, []byte(result.CC.Contents), 0644)
+	os.WriteFile(filepath.Join(outputDir, result.HH.Name), []byte(result.HH.Contents), 0644)
+	binary := filepath.Join(outputDir, "gx.bin")
+	args := []string{"-std=c++20", "-O1", "-o", binary}
+	for _, includeDir := range result.IncludeDirs {
+		args = append(args, "-I"+includeDir)
+	}
+	args = append(args, ccPath)
+	if output, err := exec.Command(cxx, args...).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("C++ compilation failed: %v\n%s", err, output)
+	}
+	return binary, nil
+}
+
+//
+// Run
+//
+
+type outcome struct {
+	lines  []string // Combined stdout and stderr, up to the first panic line
+	status string   // "exit N" or "panic"
+}
+
+// run runs a binary and normalizes its outcome so Go and gx binaries can be compared. Panics end
+// with a Go stack trace or a gx source position and exit differently, so only the panic message
+// is kept.
+func run(binary string, timeout time.Duration) outcome {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, binary)
+	output := &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = output, output
+	err := cmd.Run()
+	result := outcome{status: "exit 0"}
+	var exitErr *exec.ExitError
+	if ctx.Err() != nil {
+		result.status = "timeout"
+	} else if errors.As(err, &exitErr) {
+		result.status = fmt.Sprintf("exit %d", exitErr.ExitCode())
+	} else if err != nil {
+		result.status = err.Error()
+	}
+	for _, line := range strings.SplitAfter(output.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		result.lines = append(result.lines, strings.TrimSuffix(line, "\n"))
+		if strings.HasPrefix(line, "panic: ") && result.status != "exit 0" && result.status != "timeout" {
+			result.status = "panic"
+			break
+		}
+	}
+	return result
+}
+
+// diff describes the first difference between two outcomes, or returns "" if they're the same
+func diff(goOutcome, gxOutcome outcome) string {
+	for i := 0; i < len(goOutcome.lines) || i < len(gxOutcome.lines); i++ {
+		goLine, gxLine := "<end of output>", "<end of output>"
+		if i < len(goOutcome.lines) {
+			goLine = goOutcome.lines[i]
+		}
+		if i < len(gxOutcome.lines) {
+			gxLine = gxOutcome.lines[i]
+		}
+		if goLine != gxLine {
+			return fmt.Sprintf("output differs at line %d:\n  go: %s\n  gx: %s", i+1, goLine, gxLine)
+		}
+	}
+	if goOutcome.status != gxOutcome.status {
+		return fmt.Sprintf("status differs:\n  go: %s\n  gx: %s", goOutcome.status, gxOutcome.status)
+	}
+	return ""
+}
+
+//
+// Main
+//
+
+const usage = `usage: gxdiff [flags] <program_dir>...
+
+Builds each program with 'go build' and with gx, runs both and reports programs whose output or
+exit status differ. A directory ending in '/...' is expanded to its subdirectories containing
+'.gx.go' files.
+`
+
+// expand expands patterns ending in '/...' to directories containing '.gx.go' files
+func expand(patterns []string) ([]string, error) {
+	var dirs []string
+	for _, pattern := range patterns {
+		if !strings.HasSuffix(pattern, "/...") {
+			dirs = append(dirs, pattern)
+			continue
+		}
+		root := strings.TrimSuffix(pattern, "/...")
+		err := filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			if dir := filepath.Dir(path); strings.HasSuffix(path, ".gx.go") && (len(dirs) == 0 || dirs[len(dirs)-1] != dir) {
+				dirs = append(dirs, dir)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dirs, nil
+}
+
+func main() {
+	flags := flag.NewFlagSet("gxdiff", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		fmt.Fprintln(flags.Output(), "\nFlags:")
+		flags.PrintDefaults()
+	}
+	cxx := flags.String("cxx", "", "C++ compiler `path` (default $CXX or clang++)")
+	goCmd := flags.String("go", "go", "Go command `path`")
+	outputDir := flags.String("out", "", "`dir` for build outputs, kept for inspection (default is a temporary dir)")
+	timeout := flags.Duration("timeout", 10*time.Second, "time limit for running each binary")
+	flags.Parse(os.Args[1:])
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *cxx == "" {
+		*cxx = os.Getenv("CXX")
+	}
+	if *cxx == "" {
+		*cxx = "clang++"
+	}
+	if *outputDir == "" {
+		tempDir, err := os.MkdirTemp("", "gxdiff")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "gxdiff:", err)
+			os.Exit(1)
+		}
+		defer os.RemoveAll(tempDir)
+		*outputDir = tempDir
+	}
+	dirs, err := expand(flags.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gxdiff:", err)
+		os.Exit(1)
+	}
+
+	failed := false
+	for i, dir := range dirs {
+		programDir := filepath.Join(*outputDir, fmt.Sprintf("%d.%s", i, filepath.Base(dir)))
+		os.MkdirAll(programDir, 0755)
+		pkgPath := dir
+		if !filepath.IsAbs(pkgPath) && !strings.HasPrefix(pkgPath, ".") {
+			pkgPath = "." + string(filepath.Separator) + pkgPath
+		}
+		problem := func() string {
+			gxOverlay, goOverlay, recovers, err := overlays(pkgPath)
+			if err != nil {
+				return err.Error()
+			}
+			goBinary, err := buildGo(*goCmd, pkgPath, programDir, goOverlay)
+			if err != nil {
+				return err.Error()
+			}
+			gxBinary, err := buildGX(*cxx, pkgPath, programDir, gxOverlay, recovers)
+			if err != nil {
+				return err.Error()
+			}
+			return diff(run(goBinary, *timeout), run(gxBinary, *timeout))
+		}()
+		if problem != "" {
+			failed = true
+			fmt.Printf("FAIL %s\n%s\n", dir, problem)
+		} else {
+			fmt.Printf("ok   %s\n", dir)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
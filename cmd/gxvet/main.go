@@ -0,0 +1,12 @@
+// Command gxvet reports code gx can't compile. Run it with 'go vet -vettool=$(which gxvet) ./...'
+// or configure it as a vet tool in an editor.
+package main
+
+import (
+	"github.com/nikki93/gx/gxcheck"
+	"golang.org/x/tools/go/analysis/unitchecker"
+)
+
+func main() {
+	unitchecker.Main(gxcheck.Analyzer)
+}
@@ -0,0 +1,21 @@
+package foo
+
+import "github.com/nikki93/gx/testing"
+
+func TestNewFoo(t *testing.T) {
+	f := NewFoo(42)
+	if f.Val() != 42 {
+		t.Errorf("NewFoo(42).Val() = %d, want %d", f.Val(), 42)
+	}
+}
+
+func TestVal(t *testing.T) {
+	for _, val := range []int{0, 1, -3} {
+		t.Run("val", func(t *testing.T) {
+			f := NewFoo(val)
+			if got := f.Val(); got != val {
+				t.Fatalf("got %d, want %d", got, val)
+			}
+		})
+	}
+}
@@ -209,6 +209,63 @@ func testStruct() {
 	}
 }
 
+//
+// Large parameters
+//
+
+type Large struct {
+	a, b, c, d, e int
+}
+
+type Named struct {
+	name string
+}
+
+func largeSum(l Large) int {
+	return l.a + l.b + l.c + l.d + l.e
+}
+
+func incrLargeA(l Large) int {
+	l.a++
+	return l.a
+}
+
+//gx:byvalue
+func largeSumByValue(l Large) int {
+	return l.a + l.b + l.c + l.d + l.e
+}
+
+//gx:byref l
+func largeSumPlus(l Large, extra *int) int {
+	return largeSum(l) + *extra
+}
+
+func (n Named) firstChar() byte {
+	return n.name[0]
+}
+
+func nameLen(s string) int {
+	count := 0
+	for range s {
+		count++
+	}
+	return count
+}
+
+func testLargeParameters() {
+	l := Large{1, 2, 3, 4, 5}
+	check(largeSum(l) == 15)
+	check(largeSumByValue(l) == 15)
+	extra := 1
+	check(largeSumPlus(l, &extra) == 16)
+	check(incrLargeA(l) == 2)
+	check(l.a == 1)
+	n := Named{"foo"}
+	check(n.firstChar() == 'f')
+	check(nameLen(n.name) == 3)
+	check(nameLen("hello") == 5)
+}
+
 //
 // Methods
 //
@@ -628,6 +685,11 @@ func testGlobalVariables() {
 	{
 		check(globalApplied == 6)
 	}
+	{
+		check(globalW == 65)
+		before := Before{p: Point{x: 1, y: 2}}
+		check(before.p.x == 1)
+	}
 	{
 		check(ZeroEnum == 0)
 		check(OneEnum == 1)
@@ -674,6 +736,7 @@ func area(r Rect) float32
 //gx:extern rect::area
 func (r Rect) area() float32
 
+//gxdiff:skip Go can't call C++ externs
 func testExterns() {
 	{
 		check(RectNumVertices == 4)
@@ -733,6 +796,7 @@ type Nums struct {
 //gx:extern sumFields
 func sumFields(val interface{}) int
 
+//gxdiff:skip Go can't call C++ externs
 func testMeta() {
 	n := Nums{1, 2, 3, 4}
 	check(sumFields(n) == 14)
@@ -748,6 +812,7 @@ type HasDefaults struct {
 	point Point   `default:"{ 1, 2 }"`
 }
 
+//gxdiff:skip 'default' tags only apply in C++
 func testDefaults() {
 	h := HasDefaults{}
 	check(h.foo == 42)
@@ -767,6 +832,7 @@ type HasString struct {
 	s string
 }
 
+//gxdiff:skip Go can't call C++ externs
 func testStrings() {
 	{
 		s0 := ""
@@ -829,6 +895,26 @@ func testStrings() {
 	}
 }
 
+//
+// Defer
+//
+
+func deferIncr(val *int) int {
+	defer func() {
+		*val += 1
+	}()
+	defer func() {
+		*val *= 2
+	}()
+	return *val
+}
+
+func testDefer() {
+	val := 3
+	check(deferIncr(&val) == 3)
+	check(val == 7)
+}
+
 //
 // Main
 //
@@ -842,6 +928,7 @@ func main() {
 	testFor()
 	testPointer()
 	testStruct()
+	testLargeParameters()
 	testMethod()
 	testGenerics()
 	testLambdas()
@@ -855,4 +942,5 @@ func main() {
 	testMeta()
 	testDefaults()
 	testStrings()
+	testDefer()
 }
@@ -0,0 +1,717 @@
+package gx
+
+import (
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+//
+// In-memory loading
+//
+
+// parseProgram type-checks a single-file main package without the Go toolchain, which is much
+// faster than 'packages.Load' for fuzzing. Errors are reported like those of 'packages.Load'.
+func parseProgram(src string) []*packages.Package {
+	fileSet := token.NewFileSet()
+	pkg := &packages.Package{ID: "fuzz", Name: "main", PkgPath: "fuzz", Fset: fileSet}
+	file, err := parser.ParseFile(fileSet, "main.gx.go", src, parser.ParseComments)
+	if err != nil {
+		if list, ok := err.(scanner.ErrorList); ok {
+			for _, err := range list {
+				pkg.Errors = append(pkg.Errors, packages.Error{Pos: err.Pos.String(), Msg: err.Msg, Kind: packages.ParseError})
+			}
+		} else {
+			pkg.Errors = append(pkg.Errors, packages.Error{Msg: err.Error(), Kind: packages.ParseError})
+		}
+		return []*packages.Package{pkg}
+	}
+	pkg.Syntax = []*ast.File{file}
+	pkg.TypesInfo = &types.Info{
+		Types:      make(map[ast.Expr]types.TypeAndValue),
+		Instances:  make(map[*ast.Ident]types.Instance),
+		Defs:       make(map[*ast.Ident]types.Object),
+		Uses:       make(map[*ast.Ident]types.Object),
+		Implicits:  make(map[ast.Node]types.Object),
+		Selections: make(map[*ast.SelectorExpr]*types.Selection),
+		Scopes:     make(map[ast.Node]*types.Scope),
+	}
+	config := &types.Config{
+		Importer: importer.Default(),
+		Error: func(err error) {
+			if err, ok := err.(types.Error); ok {
+				pkg.Errors = append(pkg.Errors, packages.Error{Pos: fileSet.Position(err.Pos).String(), Msg: err.Msg, Kind: packages.TypeError})
+			}
+		},
+	}
+	pkg.Types, _ = config.Check(pkg.PkgPath, fileSet, pkg.Syntax, pkg.TypesInfo)
+	return []*packages.Package{pkg}
+}
+
+//
+// Checking
+//
+
+// fuzzCXX returns the C++ compiler used to check generated code: $GX_TEST_CXX, $CXX, or the first
+// of clang++ and g++ found. Checking is skipped if none is available.
+func fuzzCXX() string {
+	for _, env := range []string{"GX_TEST_CXX", "CXX"} {
+		if cxx := os.Getenv(env); cxx != "" {
+			return cxx
+		}
+	}
+	for _, name := range []string{"clang++", "g++"} {
+		if path, err := exec.LookPath(name); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// compileSource compiles a program and fails the test if compiling panics. If checkCXX is set and
+// the program compiles without diagnostics, the generated code must also be accepted by the C++
+// compiler.
+func compileSource(t *testing.T, src string, checkCXX bool) {
+	c := &compiler{pkgs: parseProgram(src), outputName: "main", keepAll: true}
+	func() {
+		defer func() {
+			if err := recover(); err != nil {
+				t.Fatalf("compiler panicked: %v\nsource:\n%s", err, src)
+			}
+		}()
+		c.compile()
+	}()
+	if c.errored() || !checkCXX {
+		return
+	}
+	cxx := fuzzCXX()
+	if cxx == "" {
+		return
+	}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "gx.hh"), []byte(RuntimeHeader), 0644)
+	ccPath := filepath.Join(dir, "main.gx.cc")
+	os.WriteFile(ccPath, []byte(c.outputCC.String()), 0644)
+	if output, err := exec.Command(cxx, "-std=c++20", "-fsyntax-only", ccPath).CombinedOutput(); err != nil {
+		t.Fatalf("C++ compiler rejected generated code: %v\n%s\nsource:\n%s\ngenerated:\n%s", err, output, src, c.outputCC.String())
+	}
+}
+
+//
+// Program generator
+//
+
+// generator generates random well-typed programs in the subset gx supports, so that compiling
+// them exercises code generation rather than stopping at diagnostics
+type generator struct {
+	rand    *rand.Rand
+	out     strings.Builder
+	indent  int
+	nextID  int
+	structs []genStruct
+	funcs   []genFunc
+	scopes  [][]*genVar
+}
+
+type genVar struct {
+	name string
+	typ  string
+	used bool
+}
+
+type genStruct struct {
+	name   string
+	fields []genVar
+}
+
+type genFunc struct {
+	name   string
+	recv   string // Receiver type for methods
+	params []genVar
+	result string
+}
+
+var genBaseTypes = []string{"int", "bool", "float32", "[]int"}
+
+func generateProgram(seed int64) string {
+	g := &generator{rand: rand.New(rand.NewSource(seed))}
+	g.line("package main")
+	g.line("")
+	g.line("func gmax[T int | float32](a, b T) T {")
+	g.line("\tif a > b {")
+	g.line("\t\treturn a")
+	g.line("\t}")
+	g.line("\treturn b")
+	g.line("}")
+	for i, n := 0, 1+g.rand.Intn(3); i < n; i++ {
+		g.genStruct()
+	}
+	for i, n := 0, g.rand.Intn(3); i < n; i++ {
+		name := g.newName("global")
+		typ := g.pick([]string{"int", "bool", "float32"})
+		g.line("")
+		g.line(fmt.Sprintf("var %s = %s", name, g.literal(typ)))
+		g.scopes = append(g.scopes, nil)
+		g.declare(name, typ).used = true
+	}
+	for i, n := 0, 1+g.rand.Intn(4); i < n; i++ {
+		g.genFunc()
+	}
+	g.line("")
+	g.line("func main() {")
+	g.block(3, nil, func() {
+		for _, fn := range g.funcs {
+			if fn.recv == "" && g.rand.Intn(2) == 0 {
+				g.callStmt(fn)
+			}
+		}
+	})
+	g.line("}")
+	return g.out.String()
+}
+
+func (g *generator) line(s string) {
+	g.out.WriteString(strings.Repeat("\t", g.indent))
+	g.out.WriteString(s)
+	g.out.WriteString("\n")
+}
+
+func (g *generator) newName(prefix string) string {
+	g.nextID++
+	return fmt.Sprintf("%s%d", prefix, g.nextID)
+}
+
+func (g *generator) pick(choices []string) string {
+	return choices[g.rand.Intn(len(choices))]
+}
+
+func (g *generator) valueTypes() []string {
+	typs := append([]string{}, genBaseTypes...)
+	for _, s := range g.structs {
+		typs = append(typs, s.name)
+	}
+	return typs
+}
+
+func (g *generator) findStruct(name string) *genStruct {
+	for i := range g.structs {
+		if g.structs[i].name == name {
+			return &g.structs[i]
+		}
+	}
+	return nil
+}
+
+//
+// Scopes
+//
+
+func (g *generator) declare(name, typ string) *genVar {
+	v := &genVar{name: name, typ: typ}
+	g.scopes[len(g.scopes)-1] = append(g.scopes[len(g.scopes)-1], v)
+	return v
+}
+
+// lookup returns a random variable of the given type in scope and marks it used, or returns nil
+func (g *generator) lookup(typ string) *genVar {
+	v := g.lookupTarget(typ)
+	if v != nil {
+		v.used = true
+	}
+	return v
+}
+
+// lookupTarget is lookup for assigning to the variable, which doesn't count as using it
+func (g *generator) lookupTarget(typ string) *genVar {
+	var found []*genVar
+	for _, scope := range g.scopes {
+		for _, v := range scope {
+			if v.typ == typ {
+				found = append(found, v)
+			}
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	return found[g.rand.Intn(len(found))]
+}
+
+// block generates a block of statements in a new scope starting with the given variables, using
+// any variables left unused so the program type-checks, followed by statements from extra
+func (g *generator) block(depth int, vars []*genVar, extra func()) {
+	g.indent++
+	g.scopes = append(g.scopes, vars)
+	for i, n := 0, 1+g.rand.Intn(4); i < n; i++ {
+		g.stmt(depth)
+	}
+	for _, v := range g.scopes[len(g.scopes)-1] {
+		if !v.used {
+			g.line(fmt.Sprintf("println(%s)", g.printable(v.name, v.typ)))
+		}
+	}
+	if extra != nil {
+		extra()
+	}
+	g.scopes = g.scopes[:len(g.scopes)-1]
+	g.indent--
+}
+
+// printable returns an expression that can be passed to println for a value of the given type
+func (g *generator) printable(expr, typ string) string {
+	switch typ {
+	case "int", "bool":
+		return expr
+	case "float32":
+		return fmt.Sprintf("%s > 0", expr)
+	case "[]int":
+		return fmt.Sprintf("len(%s)", expr)
+	}
+	if s := g.findStruct(typ); s != nil {
+		return g.printable(expr+"."+s.fields[0].name, s.fields[0].typ)
+	}
+	return "0"
+}
+
+//
+// Declarations
+//
+
+func (g *generator) genStruct() {
+	s := genStruct{name: g.newName("S")}
+	typs := g.valueTypes()
+	for i, n := 0, 1+g.rand.Intn(3); i < n; i++ {
+		s.fields = append(s.fields, genVar{name: g.newName("f"), typ: g.pick(typs)})
+	}
+	g.line("")
+	g.line(fmt.Sprintf("type %s struct {", s.name))
+	for _, field := range s.fields {
+		g.line(fmt.Sprintf("\t%s %s", field.name, field.typ))
+	}
+	g.line("}")
+	g.structs = append(g.structs, s)
+}
+
+func (g *generator) genFunc() {
+	fn := genFunc{name: g.newName("fn")}
+	paramTypes := []string{"int", "bool", "float32", "*[]int"}
+	for _, s := range g.structs {
+		paramTypes = append(paramTypes, s.name, "*"+s.name)
+	}
+	if g.rand.Intn(3) == 0 && len(g.structs) > 0 {
+		fn.recv = g.structs[g.rand.Intn(len(g.structs))].name
+		if g.rand.Intn(2) == 0 {
+			fn.recv = "*" + fn.recv
+		}
+	}
+	for i, n := 0, g.rand.Intn(3); i < n; i++ {
+		fn.params = append(fn.params, genVar{name: g.newName("p"), typ: g.pick(paramTypes)})
+	}
+	if g.rand.Intn(3) != 0 {
+		fn.result = g.pick(append([]string{"int", "bool", "float32"}, g.structNames()...))
+	}
+
+	var params []string
+	for _, param := range fn.params {
+		params = append(params, param.name+" "+param.typ)
+	}
+	header := "func "
+	if fn.recv != "" {
+		header += fmt.Sprintf("(recv %s) ", fn.recv)
+	}
+	header += fmt.Sprintf("%s(%s) ", fn.name, strings.Join(params, ", "))
+	if fn.result != "" {
+		header += fn.result + " "
+	}
+	header += "{"
+	g.line("")
+	g.line(header)
+	g.scopes = append(g.scopes, nil)
+	if fn.recv != "" {
+		g.declare("recv", fn.recv).used = true
+	}
+	for _, param := range fn.params {
+		g.declare(param.name, param.typ).used = true
+	}
+	g.block(3, nil, func() {
+		if g.rand.Intn(4) == 0 {
+			g.line("defer func() {")
+			g.indent++
+			g.line(fmt.Sprintf("println(%s)", g.expr("int", 2)))
+			g.indent--
+			g.line("}()")
+		}
+		if fn.result != "" {
+			g.line("return " + g.expr(fn.result, 2))
+		}
+	})
+	g.scopes = g.scopes[:len(g.scopes)-1]
+	g.line("}")
+	g.funcs = append(g.funcs, fn)
+}
+
+func (g *generator) structNames() []string {
+	var names []string
+	for _, s := range g.structs {
+		names = append(names, s.name)
+	}
+	return names
+}
+
+//
+// Statements
+//
+
+func (g *generator) stmt(depth int) {
+	switch choice := g.rand.Intn(10); {
+	case choice < 3 || depth <= 0:
+		typ := g.pick(g.valueTypes())
+		name := g.newName("v")
+		g.line(fmt.Sprintf("%s := %s", name, g.expr(typ, 2)))
+		g.declare(name, typ)
+	case choice == 3:
+		typ := g.pick(g.valueTypes())
+		if v := g.lookupTarget(typ); v != nil {
+			if typ == "int" && g.rand.Intn(2) == 0 {
+				g.line(fmt.Sprintf("%s %s %s", v.name, g.pick([]string{"+=", "-=", "*=", "|=", "&=", "^="}), g.expr("int", 2)))
+			} else {
+				g.line(fmt.Sprintf("%s = %s", v.name, g.expr(typ, 2)))
+			}
+		} else if v := g.lookup("*" + typ); v != nil && g.findStruct(typ) != nil {
+			field := g.findStruct(typ).fields[0]
+			g.line(fmt.Sprintf("%s.%s = %s", v.name, field.name, g.expr(field.typ, 2)))
+		}
+	case choice == 4:
+		g.line(fmt.Sprintf("if %s {", g.expr("bool", 2)))
+		g.block(depth-1, nil, nil)
+		if g.rand.Intn(2) == 0 {
+			g.line("} else {")
+			g.block(depth-1, nil, nil)
+		}
+		g.line("}")
+	case choice == 5:
+		i := g.newName("i")
+		g.line(fmt.Sprintf("for %s := 0; %s < %d; %s++ {", i, i, g.rand.Intn(5), i))
+		g.block(depth-1, []*genVar{{name: i, typ: "int", used: true}}, nil)
+		g.line("}")
+	case choice == 6:
+		if s := g.lookup("[]int"); s != nil {
+			i, elem := g.newName("i"), g.newName("e")
+			g.line(fmt.Sprintf("for %s, %s := range %s {", i, elem, s.name))
+			g.block(depth-1, []*genVar{{name: i, typ: "int"}, {name: elem, typ: "int"}}, nil)
+			g.line("}")
+		} else if s := g.lookup("*[]int"); s != nil {
+			g.line(fmt.Sprintf("*%s = append(*%s, %s)", s.name, s.name, g.expr("int", 2)))
+		}
+	case choice == 7:
+		if s := g.lookup("[]int"); s != nil {
+			g.line(fmt.Sprintf("%s = append(%s, %s)", s.name, s.name, g.expr("int", 2)))
+		}
+	case choice == 8:
+		if len(g.funcs) > 0 {
+			g.callStmt(g.funcs[g.rand.Intn(len(g.funcs))])
+		}
+	default:
+		name := g.newName("fl")
+		param := g.newName("a")
+		g.line(fmt.Sprintf("%s := func(%s int) int {", name, param))
+		g.indent++
+		g.scopes = append(g.scopes, []*genVar{{name: param, typ: "int", used: true}})
+		g.line("return " + g.expr("int", 2))
+		g.scopes = g.scopes[:len(g.scopes)-1]
+		g.indent--
+		g.line("}")
+		g.line(fmt.Sprintf("println(%s(%s))", name, g.expr("int", 1)))
+	}
+}
+
+func (g *generator) callStmt(fn genFunc) {
+	if call := g.call(fn); call != "" {
+		if fn.result != "" {
+			g.line(fmt.Sprintf("println(%s)", g.printable(call, fn.result)))
+		} else {
+			g.line(call)
+		}
+	}
+}
+
+// call returns a call to fn, or "" if there aren't variables to pass where pointers are needed
+func (g *generator) call(fn genFunc) string {
+	// Check first, so variables aren't marked used by a call that isn't generated
+	for _, param := range fn.params {
+		if strings.HasPrefix(param.typ, "*") && g.lookupTarget(param.typ) == nil && g.lookupTarget(param.typ[1:]) == nil {
+			return ""
+		}
+	}
+	callee := fn.name
+	if fn.recv != "" {
+		recvType := strings.TrimPrefix(fn.recv, "*")
+		v := g.lookupTarget(recvType)
+		if v == nil {
+			v = g.lookupTarget("*" + recvType)
+		}
+		if v == nil {
+			return ""
+		}
+		v.used = true
+		callee = v.name + "." + fn.name
+	}
+	var args []string
+	for _, param := range fn.params {
+		args = append(args, g.expr(param.typ, 1))
+	}
+	return fmt.Sprintf("%s(%s)", callee, strings.Join(args, ", "))
+}
+
+//
+// Expressions
+//
+
+func (g *generator) literal(typ string) string {
+	switch typ {
+	case "int":
+		return fmt.Sprint(g.rand.Intn(100))
+	case "bool":
+		return g.pick([]string{"true", "false"})
+	case "float32":
+		return fmt.Sprintf("float32(%d.5)", g.rand.Intn(10))
+	case "[]int":
+		var elems []string
+		for i, n := 0, g.rand.Intn(4); i < n; i++ {
+			elems = append(elems, fmt.Sprint(g.rand.Intn(100)))
+		}
+		return "[]int{" + strings.Join(elems, ", ") + "}"
+	}
+	return typ + "{}"
+}
+
+// expr returns an expression of the given type, or "" for a pointer type with no variable in
+// scope to point to
+func (g *generator) expr(typ string, depth int) string {
+	if strings.HasPrefix(typ, "*") {
+		if v := g.lookup(typ); v != nil {
+			return v.name
+		}
+		if v := g.lookup(typ[1:]); v != nil {
+			return "&" + v.name
+		}
+		return ""
+	}
+	if depth <= 0 || g.rand.Intn(4) == 0 {
+		if v := g.lookup(typ); v != nil {
+			return v.name
+		}
+		return g.literal(typ)
+	}
+	switch typ {
+	case "int":
+		switch g.rand.Intn(9) {
+		case 0:
+			return fmt.Sprintf("(%s %s %s)", g.expr("int", depth-1), g.pick([]string{"+", "-", "*", "&", "|", "^"}), g.expr("int", depth-1))
+		case 1:
+			return fmt.Sprintf("(%s %s %d)", g.expr("int", depth-1), g.pick([]string{"/", "%"}), 1+g.rand.Intn(9))
+		case 2:
+			if s := g.lookup("[]int"); s != nil {
+				return fmt.Sprintf("len(%s)", s.name)
+			}
+		case 3:
+			if v := g.lookup("float32"); v != nil {
+				return fmt.Sprintf("int(%s)", v.name)
+			}
+		case 4:
+			return fmt.Sprintf("gmax(%s, %s)", g.expr("int", depth-1), g.expr("int", depth-1))
+		case 5:
+			return fmt.Sprintf("-(%s)", g.expr("int", depth-1))
+		}
+	case "bool":
+		switch g.rand.Intn(5) {
+		case 0:
+			return fmt.Sprintf("(%s %s %s)", g.expr("int", depth-1), g.pick([]string{"==", "!=", "<", "<=", ">", ">="}), g.expr("int", depth-1))
+		case 1:
+			return fmt.Sprintf("(%s %s %s)", g.expr("bool", depth-1), g.pick([]string{"&&", "||"}), g.expr("bool", depth-1))
+		case 2:
+			return fmt.Sprintf("!%s", g.expr("bool", depth-1))
+		case 3:
+			return fmt.Sprintf("(%s < %s)", g.expr("float32", depth-1), g.expr("float32", depth-1))
+		}
+	case "float32":
+		switch g.rand.Intn(4) {
+		case 0:
+			return fmt.Sprintf("(%s %s %s)", g.expr("float32", depth-1), g.pick([]string{"+", "-", "*"}), g.expr("float32", depth-1))
+		case 1:
+			return fmt.Sprintf("float32(%s)", g.expr("int", depth-1))
+		case 2:
+			return fmt.Sprintf("gmax[float32](%s, %s)", g.expr("float32", depth-1), g.expr("float32", depth-1))
+		}
+	}
+	if s := g.findStruct(typ); s != nil && g.rand.Intn(2) == 0 {
+		var fields []string
+		for _, field := range s.fields {
+			if g.rand.Intn(2) == 0 {
+				fields = append(fields, field.name+": "+g.expr(field.typ, depth-1))
+			}
+		}
+		return typ + "{" + strings.Join(fields, ", ") + "}"
+	}
+	for _, s := range g.structs {
+		for _, field := range s.fields {
+			if field.typ == typ && g.rand.Intn(3) == 0 {
+				if v := g.lookup(s.name); v != nil {
+					return v.name + "." + field.name
+				}
+			}
+		}
+	}
+	for _, fn := range g.funcs {
+		if fn.result == typ && g.rand.Intn(3) == 0 {
+			if call := g.call(fn); call != "" {
+				return call
+			}
+		}
+	}
+	if v := g.lookup(typ); v != nil {
+		return v.name
+	}
+	return g.literal(typ)
+}
+
+//
+// Fuzz targets
+//
+
+// FuzzGenerated compiles random programs in the supported subset. Run with
+// 'go test -fuzz=FuzzGenerated' and set $GX_TEST_CXX to check generated code with a C++ compiler
+// other than clang++.
+func FuzzGenerated(f *testing.F) {
+	for seed := int64(0); seed < 32; seed++ {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, seed int64) {
+		compileSource(t, generateProgram(seed), true)
+	})
+}
+
+// FuzzSource compiles arbitrary source, seeded with the test programs in 'testdata'. Arbitrary
+// programs may use Go features gx doesn't check for, so only panics fail.
+func FuzzSource(f *testing.F) {
+	paths, _ := filepath.Glob(filepath.Join("testdata", "*", "*", "*.gx.go"))
+	for _, path := range paths {
+		if src, err := os.ReadFile(path); err == nil {
+			f.Add(string(src))
+		}
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		compileSource(t, src, false)
+	})
+}
+
+// TestSnippets compiles statements found by fuzzing to produce code the C++ compiler rejects.
+// Each must now either be diagnosed or compile.
+func TestSnippets(t *testing.T) {
+	const preamble = `package main
+
+type E struct{ y int }
+
+type S struct {
+	E
+	x int
+}
+
+func (s S) m() {}
+
+type G[T any] struct{ v T }
+
+func (g *G[T]) m() {}
+
+func id[T any](x T) T { return x }
+
+func main() {
+	`
+	for _, body := range []string{
+		"p := new(int); println(*p)",
+		"c := complex(1, 2); println(real(c))",
+		"println(cap([]int{}))",
+		"s := []int{1}; copy(s, s)",
+		"f := S.m; f(S{})",
+		"v := S{}; f := v.m; f()",
+		`s := "a" + "b"; println(s)`,
+		"_ = 1",
+		"for i := range 10 { println(i) }",
+		"s := S{}; s.E.y = 1",
+		"println(S{}.y)",
+		"a := [2][2]int{}; println(a[0][0])",
+		"println(G[int]{}.v)",
+		"g := G[int]{}; g.m()",
+		"x := 0; p := &x; pp := &p; println(**pp)",
+		"x := id(1); println(x)",
+		"x := id[float32](1); println(x)",
+		"x := (int)(2.0); println(x)",
+	} {
+		t.Run(body, func(t *testing.T) {
+			compileSource(t, preamble+body+"\n}\n", true)
+		})
+	}
+}
+
+// TestMissingTypeInfo compiles calls whose type information was dropped, which must be diagnosed
+// rather than crash the compiler
+func TestMissingTypeInfo(t *testing.T) {
+	const src = `package main
+
+type S struct{}
+
+func (s S) m() {}
+
+func id[T any](x T) T { return x }
+
+func main() {
+	x := id(1)
+	println(x)
+	S{}.m()
+}
+`
+	for _, drop := range []string{"types", "instances"} {
+		t.Run(drop, func(t *testing.T) {
+			pkgs := parseProgram(src)
+			info := pkgs[0].TypesInfo
+			ast.Inspect(pkgs[0].Syntax[0], func(node ast.Node) bool {
+				if call, ok := node.(*ast.CallExpr); ok {
+					switch drop {
+					case "types":
+						delete(info.Types, call.Fun)
+					case "instances":
+						if ident, ok := call.Fun.(*ast.Ident); ok {
+							delete(info.Instances, ident)
+						}
+					}
+				}
+				return true
+			})
+			c := &compiler{pkgs: pkgs, outputName: "main"}
+			c.compile()
+			if !c.errored() {
+				t.Error("missing type information wasn't diagnosed")
+			}
+		})
+	}
+}
+
+func TestLowerFirst(t *testing.T) {
+	for s, expected := range map[string]string{"": "", "X": "x", "Name": "name", "ÉTÉ": "éTÉ"} {
+		if result := lowerFirst(s); result != expected {
+			t.Errorf("lowerFirst(%q) = %q, expected %q", s, result, expected)
+		}
+	}
+}
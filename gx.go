@@ -1,34 +1,56 @@
-package main
+// Package gx compiles a subset of Go to C++. Compile returns generated sources, diagnostics and
+// metadata in memory, and the 'gx' command writes them to disk and builds them.
+package gx
 
 import (
-	"bytes"
+	"crypto/sha256"
 	_ "embed"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"go/ast"
 	"go/token"
 	"go/types"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unicode"
+	"unicode/utf8"
 
+	"github.com/nikki93/gx/gxcheck"
 	"golang.org/x/tools/go/packages"
 )
 
-type Compiler struct {
-	mainPkgPath string
+type compiler struct {
+	mainPkgPath    string
+	packagesConfig *packages.Config
+	pkgs           []*packages.Package // Loaded from `mainPkgPath` if nil
+	recover        bool
+	noChecks       bool
+	log            io.Writer
+	lineDirectives bool
+	separate       bool
+	test           bool
+	outputName     string // Base name of output files, used to include headers of separate units
+	cacheDir       string // Generated code of unchanged packages is reused from here if not empty
+	jobs           int    // Number of function bodies generated concurrently
+	keepAll        bool   // Emit declarations unreachable from roots
 
 	fileSet *token.FileSet
 	types   *types.Info
+	files   map[*packages.Package][]*ast.File // Files compiled in each package
 
 	externs         map[types.Object]string
-	fieldIndices    map[*types.Var]int
+	externsByPos    map[token.Pos]string // Fields and methods of generic types, see `externOf`
 	methodRenames   map[types.Object]string
 	methodFieldTags map[types.Object]string
 	genTypeExprs    map[types.Type]string
@@ -36,29 +58,130 @@ type Compiler struct {
 	genTypeDefns    map[*ast.TypeSpec]string
 	genTypeMetas    map[*ast.TypeSpec]string
 	genFuncDecls    map[*ast.FuncDecl]string
+	genMutex        *sync.Mutex // Guards `genTypeExprs`, which function bodies fill concurrently
+	genFuncBodies   map[*ast.FuncDecl]funcBody
+	genExportsC     map[*ast.FuncDecl]exportC // Wrappers of `//gx:export_c` functions
+	globalAccesses  map[*ast.FuncDecl]globalAccess
+	funcDeclsByPos  map[token.Pos]*ast.FuncDecl // By name position, shared by generic instances
+
+	declPkgs  map[ast.Node]*packages.Package // Package of each top-level type spec and function
+	cacheHits map[*packages.Package]*cacheEntry
+
+	indent      int
+	deferIndex  int
+	namedResult *types.Var // Named result of the function being generated, if any
+	resultLater bool       // Whether `return` assigns the named result, returned after the body
+	diagnostics []Diagnostic
+	outputCC    *strings.Builder
+	outputHH    *strings.Builder
+	outputH     string // C header of `//gx:export_c` functions
+	atBlockEnd  bool
+	ccLine      int
+	lineMap     []lineMapping
+	includeDirs []string
+	inputFiles  []string // Go files and included headers that were read, for depfiles
+	removed     []string // Unreachable declarations removed from output
+	units       []*unit
+}
 
-	indent     int
-	errors     *strings.Builder
-	outputCC   *strings.Builder
-	outputHH   *strings.Builder
-	atBlockEnd bool
+// lineMapping records that output lines starting at ccLine were generated from Go code at pos
+type lineMapping struct {
+	ccLine int
+	pos    token.Pos
 }
 
 //
 // Error and writing utilities
 //
 
-func (c *Compiler) errorf(pos token.Pos, format string, args ...interface{}) {
-	fmt.Fprintf(c.errors, "%s: ", c.fileSet.PositionFor(pos, true))
-	fmt.Fprintf(c.errors, format, args...)
-	fmt.Fprintln(c.errors)
+// Diagnostic is an error in Go code, or reported by the Go toolchain while loading it
+type Diagnostic struct {
+	File         string `json:"file"`
+	Line         int    `json:"line"`
+	Column       int    `json:"column"`
+	EndLine      int    `json:"endLine"`
+	EndColumn    int    `json:"endColumn"`
+	Severity     string `json:"severity"`
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+	SuggestedFix string `json:"suggestedFix,omitempty"`
+}
+
+// String formats the diagnostic as 'file:line:col: message'
+func (d Diagnostic) String() string {
+	if d.Line > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Message)
+	} else if d.File != "" {
+		return fmt.Sprintf("%s: %s", d.File, d.Message)
+	}
+	return d.Message
+}
+
+// span is a range of positions that can be reported in place of a node
+type span struct {
+	pos, end token.Pos
+}
+
+func (s span) Pos() token.Pos {
+	return s.pos
+}
+
+func (s span) End() token.Pos {
+	return s.end
+}
+
+func (c *compiler) errorf(code string, node ast.Node, format string, args ...interface{}) {
+	position := c.fileSet.PositionFor(node.Pos(), true)
+	end := position
+	if node.End().IsValid() {
+		end = c.fileSet.PositionFor(node.End(), true)
+	}
+	message := fmt.Sprintf(format, args...)
+	c.diagnostics = append(c.diagnostics, Diagnostic{
+		File:         position.Filename,
+		Line:         position.Line,
+		Column:       position.Column,
+		EndLine:      end.Line,
+		EndColumn:    end.Column,
+		Severity:     "error",
+		Code:         code,
+		Message:      message,
+		SuggestedFix: gxcheck.Fixes[code],
+	})
+}
+
+// goErrorf reports an error from the Go toolchain, which has a position in the form
+// 'file:line:col' if any
+func (c *compiler) goErrorf(pos string, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	diagnostic := Diagnostic{Severity: "error", Code: gxcheck.CodeGo, Message: message}
+	if pos != "" {
+		diagnostic.File = pos
+		parts := strings.Split(pos, ":")
+		if len(parts) >= 3 {
+			line, errLine := strconv.Atoi(parts[len(parts)-2])
+			column, errColumn := strconv.Atoi(parts[len(parts)-1])
+			if errLine == nil && errColumn == nil {
+				diagnostic.File = strings.Join(parts[:len(parts)-2], ":")
+				diagnostic.Line, diagnostic.Column = line, column
+				diagnostic.EndLine, diagnostic.EndColumn = line, column
+			}
+		}
+	}
+	c.diagnostics = append(c.diagnostics, diagnostic)
+}
+
+func (c *compiler) errored() bool {
+	return len(c.diagnostics) != 0
 }
 
-func (c *Compiler) errored() bool {
-	return c.errors.Len() != 0
+func (c *compiler) logTime(phase string, start time.Time) {
+	if c.log != nil {
+		fmt.Fprintf(c.log, "gx: %s took %v\n", phase, time.Since(start).Round(time.Microsecond))
+	}
 }
 
-func (c *Compiler) write(s string) {
+func (c *compiler) write(s string) {
 	c.atBlockEnd = false
 	if peek := c.outputCC.String(); len(peek) > 0 && peek[len(peek)-1] == '\n' {
 		for i := 0; i < 2*c.indent; i++ {
@@ -66,6 +189,27 @@ func (c *Compiler) write(s string) {
 		}
 	}
 	c.outputCC.WriteString(s)
+	c.ccLine += strings.Count(s, "\n")
+}
+
+func (c *compiler) mapLine(pos token.Pos) {
+	if peek := c.outputCC.String(); len(peek) > 0 && peek[len(peek)-1] != '\n' {
+		return // Only map positions at the start of a line
+	}
+	if c.lineDirectives {
+		position := c.fileSet.PositionFor(pos, true)
+		c.write("#line ")
+		c.write(strconv.Itoa(position.Line))
+		c.write(" ")
+		c.write(strconv.Quote(position.Filename))
+		c.write("\n")
+	}
+	c.lineMap = append(c.lineMap, lineMapping{ccLine: c.ccLine + 1, pos: pos})
+}
+
+func (c *compiler) genPos(pos token.Pos) string {
+	position := c.fileSet.PositionFor(pos, true)
+	return strconv.Quote(fmt.Sprintf("%s:%d:%d", filepath.Base(position.Filename), position.Line, position.Column))
 }
 
 func trimFinalSpace(s string) string {
@@ -77,6 +221,9 @@ func trimFinalSpace(s string) string {
 }
 
 func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
 	result := []rune(s)
 	result[0] = unicode.ToLower(result[0])
 	return string(result)
@@ -86,10 +233,16 @@ func lowerFirst(s string) string {
 // Types
 //
 
-func (c *Compiler) genTypeExpr(typ types.Type, pos token.Pos) string {
-	if result, ok := c.genTypeExprs[typ]; ok {
+// genTypeExpr returns the C++ type expression of a type. Unsupported types are reported at each
+// use rather than memoized, so that diagnostics don't depend on which function body used them first.
+func (c *compiler) genTypeExpr(typ types.Type, pos token.Pos) string {
+	c.genMutex.Lock()
+	result, ok := c.genTypeExprs[typ]
+	c.genMutex.Unlock()
+	if ok {
 		return result
 	} else {
+		nDiagnostics := len(c.diagnostics)
 		builder := &strings.Builder{}
 		switch typ := typ.(type) {
 		case *types.Basic:
@@ -105,7 +258,7 @@ func (c *Compiler) genTypeExpr(typ types.Type, pos token.Pos) string {
 			case types.String:
 				builder.WriteString("gx::String")
 			default:
-				c.errorf(pos, "%s not supported", typ.String())
+				c.errorf(gxcheck.CodeUnsupportedType, span{pos, pos}, "%s not supported", typ.String())
 			}
 			builder.WriteByte(' ')
 		case *types.Pointer:
@@ -145,15 +298,19 @@ func (c *Compiler) genTypeExpr(typ types.Type, pos token.Pos) string {
 			builder.WriteString(">")
 			builder.WriteByte(' ')
 		default:
-			c.errorf(pos, "%s not supported", typ.String())
+			c.errorf(gxcheck.CodeUnsupportedType, span{pos, pos}, "%s not supported", typ.String())
 		}
 		result = builder.String()
-		c.genTypeExprs[typ] = result
+		if len(c.diagnostics) == nDiagnostics {
+			c.genMutex.Lock()
+			c.genTypeExprs[typ] = result
+			c.genMutex.Unlock()
+		}
 		return result
 	}
 }
 
-func (c *Compiler) genTypeDecl(typeSpec *ast.TypeSpec) string {
+func (c *compiler) genTypeDecl(typeSpec *ast.TypeSpec) string {
 	if result, ok := c.genTypeDecls[typeSpec]; ok {
 		return result
 	} else {
@@ -191,7 +348,7 @@ func (c *Compiler) genTypeDecl(typeSpec *ast.TypeSpec) string {
 	}
 }
 
-func (c *Compiler) genTypeDefn(typeSpec *ast.TypeSpec) string {
+func (c *compiler) genTypeDefn(typeSpec *ast.TypeSpec) string {
 	if result, ok := c.genTypeDefns[typeSpec]; ok {
 		return result
 	} else {
@@ -232,7 +389,7 @@ func (c *Compiler) genTypeDefn(typeSpec *ast.TypeSpec) string {
 	}
 }
 
-func (c *Compiler) genTypeMeta(typeSpec *ast.TypeSpec) string {
+func (c *compiler) genTypeMeta(typeSpec *ast.TypeSpec) string {
 	if result, ok := c.genTypeMetas[typeSpec]; ok {
 		return result
 	} else {
@@ -345,7 +502,311 @@ func (c *Compiler) genTypeMeta(typeSpec *ast.TypeSpec) string {
 
 var methodFieldTagRe = regexp.MustCompile(`^(.*)_([^_]*)$`)
 
-func (c *Compiler) genFuncDecl(decl *ast.FuncDecl) string {
+// Trivially copyable parameters larger than this many bytes are passed by const reference
+const byRefMinSize = 16
+
+var byValueRe = regexp.MustCompile(`^//gx:byvalue\b(.*)`)
+var byRefRe = regexp.MustCompile(`^//gx:byref\b(.*)`)
+
+// cppLayout approximates the size, alignment and trivial copyability of the C++ type generated for
+// a type. ok is false if it can't be known, as with extern types and type parameters.
+func (c *compiler) cppLayout(typ types.Type) (size, align int64, trivial, ok bool) {
+	switch typ := typ.(type) {
+	case *types.Basic:
+		switch typ.Kind() {
+		case types.Bool, types.Byte:
+			return 1, 1, true, true
+		case types.Int, types.Float32, types.Float64:
+			return 4, 4, true, true
+		case types.String:
+			return 16, 8, false, true
+		}
+	case *types.Pointer:
+		return 8, 8, true, true
+	case *types.Slice:
+		return 16, 8, false, true
+	case *types.Array:
+		if size, align, trivial, ok := c.cppLayout(typ.Elem()); ok {
+			return typ.Len() * size, align, trivial, true
+		}
+	case *types.Named:
+		if _, ok := c.externs[typ.Obj()]; !ok {
+			return c.cppLayout(typ.Underlying())
+		}
+	case *types.Struct:
+		size, align, trivial = 0, 1, true
+		for i, nFields := 0, typ.NumFields(); i < nFields; i++ {
+			fieldSize, fieldAlign, fieldTrivial, ok := c.cppLayout(typ.Field(i).Type())
+			if !ok {
+				return 0, 0, false, false
+			}
+			size = (size+fieldAlign-1)/fieldAlign*fieldAlign + fieldSize
+			if fieldAlign > align {
+				align = fieldAlign
+			}
+			trivial = trivial && fieldTrivial
+		}
+		return (size + align - 1) / align * align, align, trivial, true
+	}
+	return 0, 0, false, false
+}
+
+// storageRoot returns the variable whose storage an expression refers into, if any. Storage reached
+// through a pointer isn't the variable's own.
+func (c *compiler) storageRoot(expr ast.Expr) types.Object {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		return c.types.Uses[expr]
+	case *ast.ParenExpr:
+		return c.storageRoot(expr.X)
+	case *ast.SelectorExpr:
+		if ident, ok := expr.X.(*ast.Ident); ok {
+			if _, ok := c.types.Uses[ident].(*types.PkgName); ok {
+				return c.types.Uses[expr.Sel]
+			}
+		}
+		if _, ok := c.types.TypeOf(expr.X).(*types.Pointer); !ok {
+			return c.storageRoot(expr.X)
+		}
+	case *ast.IndexExpr:
+		if _, ok := c.types.TypeOf(expr.X).(*types.Pointer); !ok {
+			return c.storageRoot(expr.X)
+		}
+	}
+	return nil
+}
+
+// inspectWrites calls write with each expression a function body modifies, takes the address of,
+// or hands to C++ code that might expect a mutable reference
+func (c *compiler) inspectWrites(body *ast.BlockStmt, write func(expr ast.Expr)) {
+	ast.Inspect(body, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.AssignStmt:
+			for _, lhs := range node.Lhs {
+				write(lhs)
+			}
+		case *ast.IncDecStmt:
+			write(node.X)
+		case *ast.RangeStmt:
+			write(node.X)
+		case *ast.UnaryExpr:
+			if node.Op == token.AND {
+				write(node.X)
+			}
+		case *ast.CallExpr:
+			if c.types.Types[node.Fun].IsType() {
+				break
+			}
+			var obj types.Object
+			switch fun := node.Fun.(type) {
+			case *ast.Ident:
+				obj = c.types.Uses[fun]
+			case *ast.SelectorExpr:
+				obj = c.types.Uses[fun.Sel]
+				if sig, ok := obj.Type().(*types.Signature); ok && sig.Recv() != nil {
+					_, recvPtr := sig.Recv().Type().(*types.Pointer)
+					if _, isExtern := c.externOf(obj); recvPtr || isExtern {
+						write(fun.X)
+					}
+				}
+			}
+			_, isExtern := c.externOf(obj)
+			builtin, isBuiltin := obj.(*types.Builtin)
+			if isExtern || (isBuiltin && builtin.Name() != "len") {
+				for _, arg := range node.Args {
+					write(arg)
+				}
+			}
+		}
+		return true
+	})
+}
+
+// readOnlyParams returns the value parameters of a function that it never modifies, takes the
+// address of, or hands to C++ code that might expect a mutable reference
+func (c *compiler) readOnlyParams(decl *ast.FuncDecl) map[types.Object]bool {
+	result := make(map[types.Object]bool)
+	var fields []*ast.Field
+	if decl.Recv != nil {
+		fields = append(fields, decl.Recv.List...)
+	}
+	fields = append(fields, decl.Type.Params.List...)
+	for _, field := range fields {
+		for _, name := range field.Names {
+			result[c.types.Defs[name]] = true
+		}
+	}
+	if decl.Body != nil {
+		c.inspectWrites(decl.Body, func(expr ast.Expr) {
+			delete(result, c.storageRoot(expr))
+		})
+	}
+	return result
+}
+
+// canReference reports whether values of a type can refer to storage outside of themselves. Slices
+// are copied along with their elements, so only their elements matter.
+func (c *compiler) canReference(typ types.Type) bool {
+	switch typ := typ.(type) {
+	case *types.Basic:
+		return false
+	case *types.Slice:
+		return c.canReference(typ.Elem())
+	case *types.Array:
+		return c.canReference(typ.Elem())
+	case *types.Named:
+		if _, ok := c.externs[typ.Obj()]; !ok {
+			return c.canReference(typ.Underlying())
+		}
+	case *types.Struct:
+		for i, nFields := 0, typ.NumFields(); i < nFields; i++ {
+			if c.canReference(typ.Field(i).Type()) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// isGlobal reports whether an object is a package-level variable
+func isGlobal(obj types.Object) bool {
+	v, ok := obj.(*types.Var)
+	return ok && v.Pkg() != nil && v.Parent() == v.Pkg().Scope()
+}
+
+// globalAccess is what a function body does with package-level variables by itself
+type globalAccess struct {
+	touches bool            // Writes to them, reaches storage through them or calls unknown code
+	callees []*ast.FuncDecl // Functions it calls or refers to
+}
+
+func (c *compiler) globalAccess(decl *ast.FuncDecl) globalAccess {
+	if access, ok := c.globalAccesses[decl]; ok {
+		return access
+	}
+	access := globalAccess{touches: decl.Body == nil}
+	if decl.Body != nil {
+		c.inspectWrites(decl.Body, func(expr ast.Expr) {
+			if isGlobal(c.storageRoot(expr)) {
+				access.touches = true
+			}
+		})
+		ast.Inspect(decl.Body, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.Ident:
+				switch obj := c.types.Uses[node].(type) {
+				case *types.Var:
+					if isGlobal(obj) && c.canReference(obj.Type()) {
+						access.touches = true
+					}
+				case *types.Func:
+					if callee, ok := c.funcDeclsByPos[obj.Pos()]; ok {
+						if _, isExtern := c.externOf(obj); !isExtern {
+							access.callees = append(access.callees, callee)
+							break
+						}
+					}
+					access.touches = true // Extern, interface method or not compiled
+				}
+			case *ast.CallExpr:
+				switch fun := node.Fun.(type) {
+				case *ast.Ident, *ast.SelectorExpr, *ast.FuncLit, *ast.ParenExpr, *ast.IndexExpr, *ast.IndexListExpr:
+				default:
+					if !c.types.Types[fun].IsType() {
+						access.touches = true
+					}
+				}
+			}
+			return true
+		})
+	}
+	c.globalAccesses[decl] = access
+	return access
+}
+
+// mayAlias reports whether a function might write to an argument's storage while reading it through
+// its parameter, which passing the parameter by const reference would observe, as with `set(x, &x)`
+// where `set` writes through its pointer. That takes a parameter that can reference storage, or
+// package-level variables being touched by the function or any function it calls.
+func (c *compiler) mayAlias(decl *ast.FuncDecl) bool {
+	sig := c.types.Defs[decl.Name].Type().(*types.Signature)
+	if recv := sig.Recv(); recv != nil && c.canReference(recv.Type()) {
+		return true
+	}
+	for i, nParams := 0, sig.Params().Len(); i < nParams; i++ {
+		if c.canReference(sig.Params().At(i).Type()) {
+			return true
+		}
+	}
+	visited := make(map[*ast.FuncDecl]bool)
+	var visit func(decl *ast.FuncDecl) bool
+	visit = func(decl *ast.FuncDecl) bool {
+		if visited[decl] {
+			return false
+		}
+		visited[decl] = true
+		access := c.globalAccess(decl)
+		if access.touches {
+			return true
+		}
+		for _, callee := range access.callees {
+			if visit(callee) {
+				return true
+			}
+		}
+		return false
+	}
+	return visit(decl)
+}
+
+// byRefParams returns the parameters of a function that are passed by const reference. Without
+// `//gx:byref` naming them, that's only done when the function can't alias its arguments.
+func (c *compiler) byRefParams(decl *ast.FuncDecl) map[types.Object]bool {
+	parseNames := func(re *regexp.Regexp) (bool, map[string]bool) {
+		if decl.Doc != nil {
+			for _, comment := range decl.Doc.List {
+				if matches := re.FindStringSubmatch(comment.Text); matches != nil {
+					names := make(map[string]bool)
+					for _, name := range strings.Fields(matches[1]) {
+						names[name] = true
+					}
+					return true, names
+				}
+			}
+		}
+		return false, nil
+	}
+	byValue, byValueNames := parseNames(byValueRe)
+	byRef, byRefNames := parseNames(byRefRe)
+
+	result := make(map[types.Object]bool)
+	aliasChecked, mayAlias := false, false
+	for obj := range c.readOnlyParams(decl) {
+		name := obj.Name()
+		if byValue && (len(byValueNames) == 0 || byValueNames[name]) {
+			continue
+		}
+		_, isStruct := obj.Type().Underlying().(*types.Struct)
+		size, _, trivial, ok := c.cppLayout(obj.Type())
+		if !ok || (trivial && !isStruct) {
+			continue
+		}
+		if byRef && (len(byRefNames) == 0 || byRefNames[name]) {
+			result[obj] = true
+		} else if !trivial || size > byRefMinSize {
+			if !aliasChecked {
+				aliasChecked, mayAlias = true, c.mayAlias(decl)
+			}
+			if !mayAlias {
+				result[obj] = true
+			}
+		}
+	}
+	return result
+}
+
+func (c *compiler) genFuncDecl(decl *ast.FuncDecl) string {
 	if result, ok := c.genFuncDecls[decl]; ok {
 		return result
 	} else {
@@ -386,9 +847,7 @@ func (c *Compiler) genFuncDecl(decl *ast.FuncDecl) string {
 		addTypeParams(sig.TypeParams())
 
 		// Return type
-		if rets := sig.Results(); rets.Len() > 1 {
-			c.errorf(decl.Type.Results.Pos(), "multiple return values not supported")
-		} else if rets.Len() == 1 {
+		if rets := sig.Results(); rets.Len() == 1 {
 			ret := rets.At(0)
 			builder.WriteString(c.genTypeExpr(ret.Type(), ret.Pos()))
 		} else {
@@ -420,7 +879,7 @@ func (c *Compiler) genFuncDecl(decl *ast.FuncDecl) string {
 					}
 					typeExpr := trimFinalSpace(c.genTypeExpr(recvNamedType, recv.Pos()))
 					if matchingTagIndex == -1 {
-						c.errorf(decl.Name.Pos(), "struct %s has no field named %s", typeExpr, fieldName)
+						c.errorf(gxcheck.CodeNoSuchField, decl.Name, "struct %s has no field named %s", typeExpr, fieldName)
 					} else {
 						fieldTagBuilder := &strings.Builder{}
 						fieldTagBuilder.WriteString("gx::FieldTag<")
@@ -441,16 +900,15 @@ func (c *Compiler) genFuncDecl(decl *ast.FuncDecl) string {
 
 		// Parameters
 		builder.WriteByte('(')
+		byRef := c.byRefParams(decl)
 		addParam := func(param *types.Var) {
 			typ := param.Type()
-			switch typ.Underlying().(type) {
-			case *types.Array:
-				c.errorf(param.Pos(), "cannot pass array by value, use pointer to array *%s instead", typ)
-			case *types.Slice:
-				c.errorf(param.Pos(), "cannot pass slice by value, use pointer to slice *%s instead", typ)
-			}
 			if _, ok := typ.(*types.Signature); ok {
 				builder.WriteString("auto &&")
+			} else if byRef[param] {
+				builder.WriteString("const ")
+				builder.WriteString(c.genTypeExpr(typ, param.Pos()))
+				builder.WriteByte('&')
 			} else {
 				builder.WriteString(c.genTypeExpr(typ, param.Pos()))
 			}
@@ -481,7 +939,21 @@ func (c *Compiler) genFuncDecl(decl *ast.FuncDecl) string {
 // Expressions
 //
 
-func (c *Compiler) writeIdent(ident *ast.Ident) {
+// externOf returns the C++ name of an extern object. Fields and methods of instantiated generic
+// types are distinct objects, found by the position of their declaration.
+func (c *compiler) externOf(obj types.Object) (string, bool) {
+	if ext, ok := c.externs[obj]; ok {
+		return ext, true
+	}
+	if obj != nil {
+		if ext, ok := c.externsByPos[obj.Pos()]; ok {
+			return ext, true
+		}
+	}
+	return "", false
+}
+
+func (c *compiler) writeIdent(ident *ast.Ident) {
 	typ := c.types.Types[ident]
 	if typ.IsNil() {
 		c.write("nullptr")
@@ -490,14 +962,14 @@ func (c *Compiler) writeIdent(ident *ast.Ident) {
 	if typ.IsBuiltin() {
 		c.write("gx::")
 	}
-	if ext, ok := c.externs[c.types.Uses[ident]]; ok {
+	if ext, ok := c.externOf(c.types.Uses[ident]); ok {
 		c.write(ext)
 	} else {
 		c.write(ident.Name) // TODO: Package namespace
 	}
 }
 
-func (c *Compiler) writeBasicLit(lit *ast.BasicLit) {
+func (c *compiler) writeBasicLit(lit *ast.BasicLit) {
 	switch lit.Kind {
 	case token.INT:
 		c.write(lit.Value)
@@ -508,12 +980,10 @@ func (c *Compiler) writeBasicLit(lit *ast.BasicLit) {
 		c.write(lit.Value)
 	case token.CHAR:
 		c.write(lit.Value)
-	default:
-		c.errorf(lit.Pos(), "unsupported literal kind")
 	}
 }
 
-func (c *Compiler) writeFuncLit(lit *ast.FuncLit) {
+func (c *compiler) writeFuncLit(lit *ast.FuncLit) {
 	sig := c.types.TypeOf(lit).(*types.Signature)
 	if c.indent == 0 {
 		c.write("[](")
@@ -533,35 +1003,14 @@ func (c *Compiler) writeFuncLit(lit *ast.FuncLit) {
 		c.write(param.Name())
 	}
 	c.write(") ")
-	c.writeBlockStmt(lit.Body)
+	c.writeFuncBody(lit.Body, sig, false)
 	c.atBlockEnd = false
 }
 
-func (c *Compiler) writeCompositeLit(lit *ast.CompositeLit) {
+func (c *compiler) writeCompositeLit(lit *ast.CompositeLit) {
 	c.write(c.genTypeExpr(c.types.TypeOf(lit), lit.Pos()))
 	c.write("{")
 	if len(lit.Elts) > 0 {
-		if _, ok := lit.Elts[0].(*ast.KeyValueExpr); ok {
-			if typ, ok := c.types.TypeOf(lit).Underlying().(*types.Struct); ok {
-				if nFields := typ.NumFields(); nFields != 0 {
-					if _, ok := c.fieldIndices[typ.Field(0)]; !ok {
-						for i := 0; i < nFields; i++ {
-							c.fieldIndices[typ.Field(i)] = i
-						}
-					}
-				}
-				lastIndex := 0
-				for _, elt := range lit.Elts {
-					field := c.types.ObjectOf(elt.(*ast.KeyValueExpr).Key.(*ast.Ident)).(*types.Var)
-					if index := c.fieldIndices[field]; index < lastIndex {
-						c.errorf(lit.Pos(), "struct literal fields must appear in definition order")
-						break
-					} else {
-						lastIndex = index
-					}
-				}
-			}
-		}
 		if c.fileSet.Position(lit.Pos()).Line == c.fileSet.Position(lit.Elts[0].Pos()).Line {
 			c.write(" ")
 			for i, elt := range lit.Elts {
@@ -584,17 +1033,19 @@ func (c *Compiler) writeCompositeLit(lit *ast.CompositeLit) {
 	c.write("}")
 }
 
-func (c *Compiler) writeParenExpr(bin *ast.ParenExpr) {
+func (c *compiler) writeParenExpr(bin *ast.ParenExpr) {
 	c.write("(")
 	c.writeExpr(bin.X)
 	c.write(")")
 }
 
-func (c *Compiler) writeSelectorExpr(sel *ast.SelectorExpr) {
+func (c *compiler) writeSelectorExpr(sel *ast.SelectorExpr) {
 	if basic, ok := c.types.TypeOf(sel.X).(*types.Basic); !(ok && basic.Kind() == types.Invalid) {
 		if _, ok := c.types.TypeOf(sel.X).(*types.Pointer); ok {
 			c.write("gx::deref(")
 			c.writeExpr(sel.X)
+			c.write(", ")
+			c.write(c.genPos(sel.Sel.Pos()))
 			c.write(")")
 		} else {
 			c.writeExpr(sel.X)
@@ -604,22 +1055,62 @@ func (c *Compiler) writeSelectorExpr(sel *ast.SelectorExpr) {
 	c.writeIdent(sel.Sel)
 }
 
-func (c *Compiler) writeIndexExpr(ind *ast.IndexExpr) {
-	if _, ok := c.types.TypeOf(ind.X).(*types.Pointer); ok {
+func (c *compiler) writeIndexExpr(ind *ast.IndexExpr) {
+	typ := c.types.TypeOf(ind.X)
+	if ptr, ok := typ.(*types.Pointer); ok {
+		typ = ptr.Elem()
 		c.write("gx::deref(")
 		c.writeExpr(ind.X)
+		c.write(", ")
+		c.write(c.genPos(ind.Lbrack))
 		c.write(")")
 	} else {
 		c.writeExpr(ind.X)
 	}
-	c.write("[")
+	if named, ok := typ.(*types.Named); ok {
+		if _, ok := c.externs[named.Obj()]; ok {
+			// Extern containers only provide `operator[]`
+			c.write("[")
+			c.writeExpr(ind.Index)
+			c.write("]")
+			return
+		}
+	}
+	c.write(".at(")
 	c.writeExpr(ind.Index)
-	c.write("]")
+	c.write(", ")
+	c.write(c.genPos(ind.Lbrack))
+	c.write(")")
+}
+
+func (c *compiler) isBuiltin(expr ast.Expr, name string) bool {
+	if ident, ok := expr.(*ast.Ident); ok {
+		if builtin, ok := c.types.Uses[ident].(*types.Builtin); ok {
+			return builtin.Name() == name
+		}
+	}
+	return false
 }
 
-func (c *Compiler) writeCallExpr(call *ast.CallExpr) {
+func (c *compiler) writeCallExpr(call *ast.CallExpr) {
+	if c.isBuiltin(call.Fun, "panic") {
+		c.write("gx::fatal(")
+		c.write(c.genPos(call.Pos()))
+		c.write(", ")
+		c.writeExpr(call.Args[0])
+		c.write(")")
+		return
+	}
+	if c.isBuiltin(call.Fun, "recover") && !c.recover {
+		c.errorf(gxcheck.CodeRecover, call, "recover requires C++ exceptions, compile with -recover to enable")
+	}
+
 	method := false
-	funType := c.types.Types[call.Fun]
+	funType, ok := c.types.Types[call.Fun]
+	if !ok || funType.Type == nil {
+		c.errorf(gxcheck.CodeInternal, call.Fun, "internal error: missing type of called expression")
+		return
+	}
 	if _, ok := funType.Type.Underlying().(*types.Signature); ok || funType.IsBuiltin() {
 		// Function or method
 		if sel, ok := call.Fun.(*ast.SelectorExpr); ok {
@@ -641,6 +1132,8 @@ func (c *Compiler) writeCallExpr(call *ast.CallExpr) {
 				if xPtr && !recvPtr {
 					c.write("gx::deref(")
 					c.writeExpr(sel.X)
+					c.write(", ")
+					c.write(c.genPos(sel.Sel.Pos()))
 					c.write(")")
 				} else if !xPtr && recvPtr {
 					c.write("&(")
@@ -653,21 +1146,32 @@ func (c *Compiler) writeCallExpr(call *ast.CallExpr) {
 		}
 		if !method {
 			var typeArgs *types.TypeList
+			instanceTypeArgs := func(ident *ast.Ident) *types.TypeList {
+				instance, ok := c.types.Instances[ident]
+				if !ok {
+					if obj, ok := c.types.Uses[ident].(*types.Func); ok {
+						if sig, ok := obj.Type().(*types.Signature); ok && sig.TypeParams().Len() > 0 {
+							c.errorf(gxcheck.CodeInternal, ident, "internal error: missing type arguments of %s", ident.Name)
+						}
+					}
+				}
+				return instance.TypeArgs
+			}
 			switch fun := call.Fun.(type) {
 			case *ast.Ident: // f(x)
 				c.writeIdent(fun)
-				typeArgs = c.types.Instances[fun].TypeArgs
+				typeArgs = instanceTypeArgs(fun)
 			case *ast.SelectorExpr: // pkg.f(x)
 				c.writeIdent(fun.Sel)
-				typeArgs = c.types.Instances[fun.Sel].TypeArgs
+				typeArgs = instanceTypeArgs(fun.Sel)
 			case *ast.IndexExpr:
 				switch fun := fun.X.(type) {
 				case *ast.Ident: // f[T](x)
 					c.writeIdent(fun)
-					typeArgs = c.types.Instances[fun].TypeArgs
+					typeArgs = instanceTypeArgs(fun)
 				case *ast.SelectorExpr: // pkg.f[T](x)
 					c.writeIdent(fun.Sel)
-					typeArgs = c.types.Instances[fun.Sel].TypeArgs
+					typeArgs = instanceTypeArgs(fun.Sel)
 				}
 			default:
 				c.writeExpr(fun)
@@ -705,27 +1209,25 @@ func (c *Compiler) writeCallExpr(call *ast.CallExpr) {
 	c.write(")")
 }
 
-func (c *Compiler) writeStarExpr(star *ast.StarExpr) {
-	c.write("*")
+func (c *compiler) writeStarExpr(star *ast.StarExpr) {
+	c.write("gx::deref(")
 	c.writeExpr(star.X)
+	c.write(", ")
+	c.write(c.genPos(star.Star))
+	c.write(")")
 }
 
-func (c *Compiler) writeUnaryExpr(un *ast.UnaryExpr) {
+func (c *compiler) writeUnaryExpr(un *ast.UnaryExpr) {
 	switch op := un.Op; op {
 	case token.ADD, token.SUB, token.NOT:
 		c.write(op.String())
 	case token.AND:
-		if !c.types.Types[un.X].Addressable() {
-			c.errorf(un.OpPos, "cannot take address of a temporary object")
-		}
 		c.write(op.String())
-	default:
-		c.errorf(un.OpPos, "unsupported unary operator")
 	}
 	c.writeExpr(un.X)
 }
 
-func (c *Compiler) writeBinaryExpr(bin *ast.BinaryExpr) {
+func (c *compiler) writeBinaryExpr(bin *ast.BinaryExpr) {
 	needParens := false
 	switch bin.Op {
 	case token.AND, token.OR, token.XOR:
@@ -742,8 +1244,6 @@ func (c *Compiler) writeBinaryExpr(bin *ast.BinaryExpr) {
 		token.AND, token.OR, token.XOR, token.SHL, token.SHR,
 		token.LAND, token.LOR:
 		c.write(op.String())
-	default:
-		c.errorf(bin.OpPos, "unsupported binary operator")
 	}
 	c.write(" ")
 	c.writeExpr(bin.Y)
@@ -752,10 +1252,8 @@ func (c *Compiler) writeBinaryExpr(bin *ast.BinaryExpr) {
 	}
 }
 
-func (c *Compiler) writeKeyValueExpr(kv *ast.KeyValueExpr) {
-	if name, ok := kv.Key.(*ast.Ident); !ok {
-		c.errorf(kv.Pos(), "unsupported literal key")
-	} else {
+func (c *compiler) writeKeyValueExpr(kv *ast.KeyValueExpr) {
+	if name, ok := kv.Key.(*ast.Ident); ok {
 		c.write(".")
 		c.writeIdent(name)
 		c.write(" = ")
@@ -763,7 +1261,7 @@ func (c *Compiler) writeKeyValueExpr(kv *ast.KeyValueExpr) {
 	}
 }
 
-func (c *Compiler) writeExpr(expr ast.Expr) {
+func (c *compiler) writeExpr(expr ast.Expr) {
 	switch expr := expr.(type) {
 	case *ast.Ident:
 		c.writeIdent(expr)
@@ -789,29 +1287,36 @@ func (c *Compiler) writeExpr(expr ast.Expr) {
 		c.writeBinaryExpr(expr)
 	case *ast.KeyValueExpr:
 		c.writeKeyValueExpr(expr)
-	default:
-		c.errorf(expr.Pos(), "unsupported expression type")
 	}
 }
 
+// genExpr generates an expression outside of the '.cc', such as for a header
+func (c *compiler) genExpr(expr ast.Expr) string {
+	outputCC, ccLine, lineMap := c.outputCC, c.ccLine, c.lineMap
+	c.outputCC = &strings.Builder{}
+	c.writeExpr(expr)
+	result := c.outputCC.String()
+	c.outputCC, c.ccLine, c.lineMap = outputCC, ccLine, lineMap
+	return result
+}
+
 //
 // Statements
 //
 
-func (c *Compiler) writeExprStmt(exprStmt *ast.ExprStmt) {
+func (c *compiler) writeExprStmt(exprStmt *ast.ExprStmt) {
 	c.writeExpr(exprStmt.X)
 }
 
-func (c *Compiler) writeIncDecStmt(incDecStmt *ast.IncDecStmt) {
+func (c *compiler) writeIncDecStmt(incDecStmt *ast.IncDecStmt) {
 	c.write("(")
 	c.writeExpr(incDecStmt.X)
 	c.write(")")
 	c.write(incDecStmt.Tok.String())
 }
 
-func (c *Compiler) writeAssignStmt(assignStmt *ast.AssignStmt) {
+func (c *compiler) writeAssignStmt(assignStmt *ast.AssignStmt) {
 	if len(assignStmt.Lhs) != 1 {
-		c.errorf(assignStmt.Pos(), "multi-value assignment unsupported")
 		return
 	}
 	if assignStmt.Tok == token.DEFINE {
@@ -830,34 +1335,56 @@ func (c *Compiler) writeAssignStmt(assignStmt *ast.AssignStmt) {
 		token.ADD_ASSIGN, token.SUB_ASSIGN, token.MUL_ASSIGN, token.QUO_ASSIGN, token.REM_ASSIGN,
 		token.AND_ASSIGN, token.OR_ASSIGN, token.XOR_ASSIGN, token.SHL_ASSIGN, token.SHR_ASSIGN:
 		c.write(op.String())
-	default:
-		c.errorf(assignStmt.TokPos, "unsupported assignment operator")
 	}
 	c.write(" ")
 	c.writeExpr(assignStmt.Rhs[0])
 }
 
-func (c *Compiler) writeReturnStmt(retStmt *ast.ReturnStmt) {
-	if len(retStmt.Results) > 1 {
-		c.errorf(retStmt.Results[0].Pos(), "multiple return values not supported")
-	} else if len(retStmt.Results) == 1 {
+func (c *compiler) writeReturnStmt(retStmt *ast.ReturnStmt) {
+	switch {
+	case len(retStmt.Results) == 1 && c.resultLater:
+		c.write(c.namedResult.Name())
+		c.write(" = ")
+		c.writeExpr(retStmt.Results[0])
+		c.write(";\n")
+		c.write("return")
+	case len(retStmt.Results) == 1:
 		c.write("return ")
 		c.writeExpr(retStmt.Results[0])
-	} else {
+	case c.namedResult != nil && !c.resultLater:
+		c.write("return ")
+		c.write(c.namedResult.Name())
+	default:
 		c.write("return")
 	}
 }
 
-func (c *Compiler) writeBranchStmt(branchStmt *ast.BranchStmt) {
+func (c *compiler) writeBranchStmt(branchStmt *ast.BranchStmt) {
 	switch tok := branchStmt.Tok; tok {
 	case token.BREAK, token.CONTINUE:
 		c.write(tok.String())
-	default:
-		c.errorf(branchStmt.TokPos, "unsupported branch statement")
 	}
 }
 
-func (c *Compiler) writeBlockStmt(block *ast.BlockStmt) {
+func (c *compiler) writeDeferStmt(deferStmt *ast.DeferStmt) {
+	c.write("gx::Defer defer")
+	c.write(strconv.Itoa(c.deferIndex))
+	c.deferIndex++
+	c.write("(")
+	if lit, ok := deferStmt.Call.Fun.(*ast.FuncLit); ok {
+		c.writeFuncLit(lit)
+	} else {
+		c.write("[&]() {\n")
+		c.indent++
+		c.writeCallExpr(deferStmt.Call)
+		c.write(";\n")
+		c.indent--
+		c.write("}")
+	}
+	c.write(")")
+}
+
+func (c *compiler) writeBlockStmt(block *ast.BlockStmt) {
 	c.write("{\n")
 	c.indent++
 	c.writeStmtList(block.List)
@@ -866,7 +1393,7 @@ func (c *Compiler) writeBlockStmt(block *ast.BlockStmt) {
 	c.atBlockEnd = true
 }
 
-func (c *Compiler) writeIfStmt(ifStmt *ast.IfStmt) {
+func (c *compiler) writeIfStmt(ifStmt *ast.IfStmt) {
 	c.write("if (")
 	if ifStmt.Init != nil {
 		c.writeStmt(ifStmt.Init)
@@ -881,7 +1408,7 @@ func (c *Compiler) writeIfStmt(ifStmt *ast.IfStmt) {
 	}
 }
 
-func (c *Compiler) writeForStmt(forStmt *ast.ForStmt) {
+func (c *compiler) writeForStmt(forStmt *ast.ForStmt) {
 	c.write("for (")
 	if forStmt.Init != nil {
 		c.writeStmt(forStmt.Init)
@@ -898,10 +1425,7 @@ func (c *Compiler) writeForStmt(forStmt *ast.ForStmt) {
 	c.writeStmt(forStmt.Body)
 }
 
-func (c *Compiler) writeRangeStmt(rangeStmt *ast.RangeStmt) {
-	if rangeStmt.Tok == token.ASSIGN {
-		c.errorf(rangeStmt.TokPos, "must use := in range statement")
-	}
+func (c *compiler) writeRangeStmt(rangeStmt *ast.RangeStmt) {
 	var key *ast.Ident
 	if rangeStmt.Key != nil {
 		if ident, ok := rangeStmt.Key.(*ast.Ident); ok && ident.Name != "_" {
@@ -939,7 +1463,7 @@ func (c *Compiler) writeRangeStmt(rangeStmt *ast.RangeStmt) {
 	c.atBlockEnd = true
 }
 
-func (c *Compiler) writeStmt(stmt ast.Stmt) {
+func (c *compiler) writeStmt(stmt ast.Stmt) {
 	switch stmt := stmt.(type) {
 	case *ast.ExprStmt:
 		c.writeExprStmt(stmt)
@@ -959,13 +1483,14 @@ func (c *Compiler) writeStmt(stmt ast.Stmt) {
 		c.writeForStmt(stmt)
 	case *ast.RangeStmt:
 		c.writeRangeStmt(stmt)
-	default:
-		c.errorf(stmt.Pos(), "unsupported statement type")
+	case *ast.DeferStmt:
+		c.writeDeferStmt(stmt)
 	}
 }
 
-func (c *Compiler) writeStmtList(list []ast.Stmt) {
+func (c *compiler) writeStmtList(list []ast.Stmt) {
 	for _, stmt := range list {
+		c.mapLine(stmt.Pos())
 		c.writeStmt(stmt)
 		if !c.atBlockEnd {
 			c.write(";")
@@ -974,87 +1499,1471 @@ func (c *Compiler) writeStmtList(list []ast.Stmt) {
 	}
 }
 
-//
-// Top-level
-//
-
-func (c *Compiler) compile() {
-	// Initialize maps
-	c.externs = make(map[types.Object]string)
-	c.fieldIndices = make(map[*types.Var]int)
-	c.methodRenames = make(map[types.Object]string)
-	c.methodFieldTags = make(map[types.Object]string)
-	c.genTypeExprs = make(map[types.Type]string)
-	c.genTypeDecls = make(map[*ast.TypeSpec]string)
-	c.genTypeDefns = make(map[*ast.TypeSpec]string)
-	c.genTypeMetas = make(map[*ast.TypeSpec]string)
-	c.genFuncDecls = make(map[*ast.FuncDecl]string)
-
-	// Initialize builders
-	c.errors = &strings.Builder{}
-	c.outputCC = &strings.Builder{}
-	c.outputHH = &strings.Builder{}
-
-	// Load main package
-	packagesConfig := &packages.Config{
-		Mode: packages.NeedImports | packages.NeedDeps |
-			packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo,
+func (c *compiler) writeFuncBody(body *ast.BlockStmt, sig *types.Signature, isMain bool) {
+	// Deferred calls run as destructors of guards declared in the outermost block. A guard that
+	// calls `recover` needs the body wrapped so the panic can be caught.
+	recovers := false
+	{
+		ast.Inspect(body, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.DeferStmt:
+				ast.Inspect(node.Call, func(node ast.Node) bool {
+					if call, ok := node.(*ast.CallExpr); ok && c.isBuiltin(call.Fun, "recover") {
+						recovers = true
+					}
+					return true
+				})
+				return false
+			}
+			return true
+		})
 	}
-	loadPkgs, err := packages.Load(packagesConfig, c.mainPkgPath)
-	if err != nil {
-		fmt.Fprintln(c.errors, err)
+	prevDeferIndex := c.deferIndex
+	c.deferIndex = 0
+
+	// Named results are declared before the body so that deferred calls can assign them after a
+	// `return` or a recovered panic. With deferred calls the body is a lambda, letting them run
+	// before the result is read.
+	prevNamedResult, prevResultLater := c.namedResult, c.resultLater
+	c.namedResult, c.resultLater = nil, false
+	if results := sig.Results(); results.Len() == 1 && results.At(0).Name() != "" && results.At(0).Name() != "_" {
+		c.namedResult = results.At(0)
+		c.resultLater = len(body.List) > 0 && hasDefer(body)
 	}
-	if len(loadPkgs) == 0 {
-		return
+	writeCatch := func() {
+		c.write(" catch (gx::Panic &) {\n")
+		c.indent++
+		c.write("if (gx::panicking) {\n")
+		c.indent++
+		c.write("throw;\n")
+		c.indent--
+		c.write("}\n")
+		switch {
+		case c.namedResult != nil:
+			c.write("return ")
+			c.write(c.namedResult.Name())
+			c.write(";\n")
+		case sig.Results().Len() > 0 || isMain:
+			c.write("return {};\n")
+		default:
+			c.write("return;\n")
+		}
+		c.indent--
+		c.write("}")
 	}
-	for _, pkg := range loadPkgs {
-		for _, err := range pkg.Errors {
-			if err.Pos != "" {
-				fmt.Fprintf(c.errors, "%s: %s\n", err.Pos, err.Msg)
-			} else {
-				fmt.Fprintln(c.errors, err.Msg)
+	writeBody := func() {
+		c.writeBlockStmt(body)
+		if recovers && c.recover {
+			writeCatch()
+		}
+	}
+	writeNamedBody := func() {
+		c.write("{\n")
+		c.indent++
+		c.write(c.genTypeExpr(c.namedResult.Type(), c.namedResult.Pos()))
+		c.write(c.namedResult.Name())
+		c.write(" {};\n")
+		if c.resultLater {
+			if recovers && c.recover {
+				c.write("try {\n")
+				c.indent++
 			}
+			c.write("[&]() ")
+			c.writeBlockStmt(body)
+			c.write("();\n")
+			if recovers && c.recover {
+				c.indent--
+				c.write("}")
+				writeCatch()
+				c.write("\n")
+			}
+			c.write("return ")
+			c.write(c.namedResult.Name())
+			c.write(";\n")
+		} else {
+			c.writeStmtList(body.List)
 		}
+		c.indent--
+		c.write("}")
 	}
-	if c.errored() {
-		return
+	wrapBody := func(writeInner func()) {
+		c.write("{\n")
+		c.indent++
+		c.write("try ")
+		writeInner()
+		c.write("\n")
+		c.indent--
+		c.write("}")
 	}
-	c.fileSet = loadPkgs[0].Fset
-
-	// Collect packages
-	var pkgs []*packages.Package
-	{
-		visited := make(map[*packages.Package]bool)
-		var visit func(pkg *packages.Package)
-		visit = func(pkg *packages.Package) {
-			if !visited[pkg] {
-				visited[pkg] = true
-				for _, dep := range pkg.Imports {
-					visit(dep)
-				}
-				pkgs = append(pkgs, pkg)
-				if pkg.Fset != c.fileSet {
-					c.errorf(0, "internal error: filesets differ")
-				}
+	switch {
+	case c.namedResult != nil:
+		writeNamedBody()
+	case !c.recover:
+		writeBody()
+	case isMain:
+		wrapBody(func() {
+			if recovers {
+				wrapBody(writeBody)
+			} else {
+				c.writeBlockStmt(body)
 			}
-		}
-		for _, pkg := range loadPkgs {
-			visit(pkg)
+			c.write(" catch (gx::Panic &) {\n")
+			c.indent++
+			c.write("gx::crash(gx::panicMsg, gx::panicPos);\n")
+			c.indent--
+			c.write("}")
+		})
+	case recovers:
+		wrapBody(writeBody)
+	default:
+		writeBody()
+	}
+	c.deferIndex = prevDeferIndex
+	c.namedResult, c.resultLater = prevNamedResult, prevResultLater
+	c.atBlockEnd = true
+}
+
+// hasDefer returns whether a function body has a `defer` statement, which are only supported at
+// its top level
+func hasDefer(body *ast.BlockStmt) bool {
+	for _, stmt := range body.List {
+		if _, ok := stmt.(*ast.DeferStmt); ok {
+			return true
 		}
 	}
-	sort.Slice(pkgs, func(i, j int) bool {
-		return pkgs[i].ID < pkgs[j].ID
-	})
+	return false
+}
 
-	// Collect types info
-	c.types = &types.Info{
-		Types:      make(map[ast.Expr]types.TypeAndValue),
-		Instances:  make(map[*ast.Ident]types.Instance),
-		Defs:       make(map[*ast.Ident]types.Object),
-		Uses:       make(map[*ast.Ident]types.Object),
-		Implicits:  make(map[ast.Node]types.Object),
-		Selections: make(map[*ast.SelectorExpr]*types.Selection),
-		Scopes:     make(map[ast.Node]*types.Scope),
+// funcBody is the generated code of a function body, with line mappings relative to its first line
+type funcBody struct {
+	code    string
+	lineMap []lineMapping
+}
+
+// genBodies generates bodies of functions that weren't cached, spreading them across `c.jobs`
+// workers. Each worker writes through its own copy of the compiler, so only memo maps are shared.
+// Function declarations must have been generated first, since calls use the method renames they
+// record. Diagnostics are kept in the order of the functions.
+func (c *compiler) genBodies(funcDecls []*ast.FuncDecl) {
+	var decls []*ast.FuncDecl
+	for _, funcDecl := range funcDecls {
+		if _, ok := c.genFuncBodies[funcDecl]; !ok && funcDecl.Body != nil {
+			decls = append(decls, funcDecl)
+		}
+	}
+	bodies := make([]funcBody, len(decls))
+	diagnostics := make([][]Diagnostic, len(decls))
+	jobs := c.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	var next int64 = -1
+	var wait sync.WaitGroup
+	for i := 0; i < jobs && i < len(decls); i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			w := *c
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(decls) {
+					return
+				}
+				decl := decls[i]
+				obj := c.types.Defs[decl.Name]
+				isMain := obj.Pkg().Name() == "main" && obj.Name() == "main" && decl.Recv == nil
+				w.outputCC = &strings.Builder{}
+				w.ccLine = 0
+				w.lineMap = nil
+				w.indent = 0
+				w.diagnostics = nil
+				w.writeFuncBody(decl.Body, obj.Type().(*types.Signature), isMain)
+				bodies[i] = funcBody{code: w.outputCC.String(), lineMap: w.lineMap}
+				diagnostics[i] = w.diagnostics
+			}
+		}()
+	}
+	wait.Wait()
+	for i, decl := range decls {
+		c.genFuncBodies[decl] = bodies[i]
+		c.diagnostics = append(c.diagnostics, diagnostics[i]...)
+	}
+}
+
+// writeGenFuncBody writes the generated body of a function
+func (c *compiler) writeGenFuncBody(decl *ast.FuncDecl) {
+	body := c.genFuncBodies[decl]
+	for _, mapping := range body.lineMap {
+		c.lineMap = append(c.lineMap, lineMapping{ccLine: c.ccLine + mapping.ccLine, pos: mapping.pos})
+	}
+	c.outputCC.WriteString(body.code)
+	c.ccLine += strings.Count(body.code, "\n")
+	c.atBlockEnd = true
+}
+
+//
+// Separate compilation
+//
+
+// unit is the output for one package when generating a separate compilation unit per package
+type unit struct {
+	pkg       *packages.Package
+	name      string // Suffix of output file names, empty for the main package
+	imports   []*unit
+	outputCC  string
+	outputHH  string
+	lineMapCC []lineMapping
+	lineMapHH []lineMapping
+}
+
+// isTemplate reports whether a function generates a C++ template, which must be defined in headers
+func (c *compiler) isTemplate(decl *ast.FuncDecl) bool {
+	sig := c.types.Defs[decl.Name].Type().(*types.Signature)
+	if sig.TypeParams() != nil {
+		return true
+	}
+	if recv := sig.Recv(); recv != nil {
+		recvType := recv.Type()
+		if ptr, ok := recvType.(*types.Pointer); ok {
+			recvType = ptr.Elem()
+		}
+		if named, ok := recvType.(*types.Named); ok && named.TypeParams() != nil {
+			return true
+		}
+	}
+	for i, nParams := 0, sig.Params().Len(); i < nParams; i++ {
+		if _, ok := sig.Params().At(i).Type().(*types.Signature); ok {
+			return true // Function parameters are `auto &&`
+		}
+	}
+	return false
+}
+
+// mainPkg returns the root package being compiled, preferring the one named 'main' if several
+// were loaded
+func (c *compiler) mainPkg() *packages.Package {
+	for _, pkg := range c.pkgs {
+		if pkg.Name == "main" {
+			return pkg
+		}
+	}
+	return c.pkgs[0]
+}
+
+func (c *compiler) writeUnits(pkgs []*packages.Package, defines string, pkgIncludes map[*packages.Package][]string,
+	typeSpecs []*ast.TypeSpec, valueSpecs []*ast.ValueSpec, funcDecls []*ast.FuncDecl, behaviors map[types.Object]bool,
+	tests []*ast.FuncDecl) {
+	// Name units after package paths relative to the main package
+	pkgUnits := make(map[*packages.Package]*unit)
+	mainPkgPath := c.mainPkg().PkgPath
+	for _, pkg := range pkgs {
+		u := &unit{pkg: pkg}
+		if pkg.PkgPath != mainPkgPath {
+			name := strings.TrimPrefix(pkg.PkgPath, mainPkgPath+"/")
+			u.name = strings.NewReplacer("/", ".", "\\", ".").Replace(name)
+		}
+		pkgUnits[pkg] = u
+		c.units = append(c.units, u)
+	}
+	for _, u := range c.units {
+		for _, imp := range u.pkg.Imports {
+			if impUnit, ok := pkgUnits[imp]; ok {
+				u.imports = append(u.imports, impUnit)
+			}
+		}
+		sort.Slice(u.imports, func(i, j int) bool {
+			return u.imports[i].pkg.ID < u.imports[j].pkg.ID
+		})
+	}
+	objUnit := func(obj types.Object) *unit {
+		for _, u := range c.units {
+			if u.pkg.Types == obj.Pkg() {
+				return u
+			}
+		}
+		return nil
+	}
+
+	for _, u := range c.units {
+		// Header
+		c.outputCC = &strings.Builder{}
+		c.ccLine = 0
+		c.lineMap = nil
+		{
+			// `#pragma once` and includes
+			c.write("#pragma once\n\n")
+			c.write(defines)
+			for _, include := range pkgIncludes[u.pkg] {
+				c.write("#include ")
+				c.write(include)
+				c.write("\n")
+			}
+			c.write("#include \"gx.hh\"\n")
+			for _, imp := range u.imports {
+				c.write("#include \"")
+				c.write(c.unitFileName(imp, ".gx.hh"))
+				c.write("\"\n")
+			}
+
+			// Types
+			c.write("\n\n")
+			c.write("//\n// Types\n//\n\n")
+			for _, typeSpec := range typeSpecs {
+				if objUnit(c.types.Defs[typeSpec.Name]) == u {
+					if typeDecl := c.genTypeDecl(typeSpec); typeDecl != "" {
+						c.write(typeDecl)
+						c.write(";\n")
+					}
+				}
+			}
+			for _, typeSpec := range typeSpecs {
+				if objUnit(c.types.Defs[typeSpec.Name]) == u {
+					if typeDefn := c.genTypeDefn(typeSpec); typeDefn != "" {
+						c.write("\n")
+						c.mapLine(typeSpec.Pos())
+						c.write(typeDefn)
+						c.write(";\n")
+					}
+				}
+			}
+
+			// Meta
+			c.write("\n\n")
+			c.write("//\n// Meta\n//\n")
+			for _, typeSpec := range typeSpecs {
+				if objUnit(c.types.Defs[typeSpec.Name]) == u {
+					if typeDecl := c.genTypeDecl(typeSpec); typeDecl != "" {
+						if meta := c.genTypeMeta(typeSpec); meta != "" {
+							c.write("\n")
+							c.write(meta)
+							c.write("\n")
+						}
+					}
+				}
+			}
+
+			// Function declarations
+			c.write("\n\n")
+			c.write("//\n// Function declarations\n//\n\n")
+			for _, funcDecl := range funcDecls {
+				if objUnit(c.types.Defs[funcDecl.Name]) == u {
+					c.mapLine(funcDecl.Pos())
+					c.write(c.genFuncDecl(funcDecl))
+					c.write(";\n")
+				}
+			}
+
+			// Variables, `inline` so they're defined once and initialized after those of imports
+			c.write("\n\n")
+			c.write("//\n// Variables\n//\n\n")
+			for _, valueSpec := range valueSpecs {
+				if objUnit(c.types.Defs[valueSpec.Names[0]]) == u {
+					for i, name := range valueSpec.Names {
+						c.mapLine(name.Pos())
+						if name.Obj.Kind == ast.Con {
+							c.write("inline constexpr ")
+						} else {
+							c.write("inline ")
+						}
+						c.write(c.genTypeExpr(c.types.TypeOf(valueSpec.Names[i]), valueSpec.Pos()))
+						c.writeIdent(name)
+						if len(valueSpec.Values) > 0 {
+							c.write(" = ")
+							c.writeExpr(valueSpec.Values[i])
+						}
+						c.write(";\n")
+					}
+				}
+			}
+
+			// Template function definitions
+			c.write("\n\n")
+			c.write("//\n// Template function definitions\n//\n")
+			for _, funcDecl := range funcDecls {
+				if objUnit(c.types.Defs[funcDecl.Name]) == u && funcDecl.Body != nil && c.isTemplate(funcDecl) {
+					c.write("\n")
+					c.mapLine(funcDecl.Pos())
+					c.write(c.genFuncDecl(funcDecl))
+					c.write(" ")
+					c.writeGenFuncBody(funcDecl)
+					c.write("\n")
+				}
+			}
+		}
+		u.outputHH = c.outputCC.String()
+		u.lineMapHH = c.lineMap
+
+		// Source
+		c.outputCC = &strings.Builder{}
+		c.ccLine = 0
+		c.lineMap = nil
+		{
+			// Include
+			c.write("#include \"")
+			c.write(c.unitFileName(u, ".gx.hh"))
+			c.write("\"\n")
+
+			// Components, registered once by the main unit, which sees all types through its imports
+			var components []*ast.TypeSpec
+			if u.name == "" {
+				for _, typeSpec := range typeSpecs {
+					if behaviors[c.types.Defs[typeSpec.Name]] {
+						components = append(components, typeSpec)
+					}
+				}
+			}
+			if len(components) > 0 {
+				c.write("\n\n")
+				c.write("//\n// Components\n//\n\n")
+				for _, typeSpec := range components {
+					c.write("ComponentTypeListAdd(")
+					c.write(typeSpec.Name.String())
+					c.write(");\n")
+				}
+			}
+
+			// Function definitions
+			c.write("\n\n")
+			c.write("//\n// Function definitions\n//\n")
+			for _, funcDecl := range funcDecls {
+				if objUnit(c.types.Defs[funcDecl.Name]) == u && funcDecl.Body != nil && !c.isTemplate(funcDecl) {
+					c.write("\n")
+					c.mapLine(funcDecl.Pos())
+					c.write(c.genFuncDecl(funcDecl))
+					c.write(" ")
+					c.writeGenFuncBody(funcDecl)
+					c.write("\n")
+				}
+			}
+			// C exports
+			var unitExportsC []*ast.FuncDecl
+			for _, funcDecl := range funcDecls {
+				if _, ok := c.genExportsC[funcDecl]; ok && objUnit(c.types.Defs[funcDecl.Name]) == u {
+					unitExportsC = append(unitExportsC, funcDecl)
+				}
+			}
+			if len(unitExportsC) > 0 {
+				c.write("\n\n")
+				c.write("//\n// C exports\n//\n")
+				c.writeExportsC(unitExportsC)
+			}
+
+			if c.test && u.name == "" {
+				c.writeTestRunner(tests)
+			}
+		}
+		u.outputCC = c.outputCC.String()
+		u.lineMapCC = c.lineMap
+	}
+	c.outputCC = &strings.Builder{}
+	c.lineMap = nil
+}
+
+//
+// C exports
+//
+
+var exportCRe = regexp.MustCompile(`^//gx:export_c (\w+)\s*$`)
+
+// exportCName returns the C name given by a `//gx:export_c name` directive, if any
+func exportCName(doc *ast.CommentGroup) string {
+	if doc != nil {
+		for _, comment := range doc.List {
+			if matches := exportCRe.FindStringSubmatch(comment.Text); matches != nil {
+				return matches[1]
+			}
+		}
+	}
+	return ""
+}
+
+// exportC is the generated code of an exported function's wrapper
+type exportC struct {
+	decl  string // C declaration
+	body  string
+	notes []string // Caveats documented in the C header
+}
+
+// cParam describes how a parameter or result of an exported function crosses the C ABI
+type cParam struct {
+	decls []string // Declarations in the C signature
+	arg   string   // Argument passed to the gx function
+	pre   string   // Conversion before the call
+	post  string   // Copying back after the call
+	note  string   // Caveat documented in the C header
+}
+
+// genCType returns the C type of a basic type or a pointer to a struct, which cross the C ABI as
+// is. Like generated type expressions, it ends with a space unless it ends with '*'.
+func (c *compiler) genCType(typ types.Type) (string, bool) {
+	switch typ := typ.(type) {
+	case *types.Basic:
+		switch typ.Kind() {
+		case types.Bool, types.Int, types.Float32, types.Byte:
+			return c.genTypeExpr(typ, token.NoPos), true
+		}
+	case *types.Pointer:
+		if structName, ok := c.cStructName(typ.Elem()); ok {
+			return structName + " *", true
+		}
+	}
+	return "", false
+}
+
+// cStructName returns the name of a non-generic struct type declared in gx, which C code sees as
+// an opaque struct unless it's passed by value
+func (c *compiler) cStructName(typ types.Type) (string, bool) {
+	if named, ok := typ.(*types.Named); ok && named.TypeArgs() == nil {
+		if _, ok := named.Underlying().(*types.Struct); ok {
+			if _, ok := c.externs[named.Obj()]; !ok {
+				return named.Obj().Name(), true
+			}
+		}
+	}
+	return "", false
+}
+
+// genCParam describes how a parameter crosses the C ABI. Strings and slices of basic types are
+// passed as pointer and length, with slices copied back after the call. Structs are passed by
+// pointer.
+func (c *compiler) genCParam(typ types.Type, name string) (cParam, bool) {
+	if cType, ok := c.genCType(typ); ok {
+		return cParam{decls: []string{cType + name}, arg: name}, true
+	}
+	if basic, ok := typ.(*types.Basic); ok && basic.Kind() == types.String {
+		return cParam{
+			decls: []string{"const char *" + name + "_data", "int " + name + "_len"},
+			arg:   "gx::String(" + name + "_data, " + name + "_len)",
+		}, true
+	}
+	if structName, ok := c.cStructName(typ); ok {
+		return cParam{decls: []string{"const " + structName + " *" + name}, arg: "*" + name}, true
+	}
+	if ptr, ok := typ.(*types.Pointer); ok {
+		if elemType, ok := c.sliceCElemType(ptr.Elem()); ok {
+			return cParam{
+				decls: []string{elemType + "*" + name + "_data", "int " + name + "_len"},
+				arg:   "&" + name,
+				pre:   "gx::Slice<" + trimFinalSpace(elemType) + "> " + name + ";\n" + name + ".copyFrom(" + name + "_data, " + name + "_len);\n",
+				post:  "for (auto i = 0; i < " + name + "_len && i < " + name + ".size; ++i) {\n  " + name + "_data[i] = " + name + ".data[i];\n}\n",
+				note: "'" + name + "' is copied back up to '" + name + "_len' elements, so elements the function " +
+					"appends are dropped",
+			}, true
+		}
+	}
+	return cParam{}, false
+}
+
+// genExportC generates the C declaration of a `//gx:export_c` function and the body of its wrapper.
+// Strings and slices are returned as pointer and length through out parameters, pointing to storage
+// that stays valid until the next call. Structs are returned through a pointer to fill in.
+func (c *compiler) genExportC(decl *ast.FuncDecl, name string) exportC {
+	sig := c.types.Defs[decl.Name].Type().(*types.Signature)
+	var params []string
+	body := &strings.Builder{}
+	var args []string
+	var post strings.Builder
+	var notes []string
+	if sig.Recv() != nil {
+		c.errorf(gxcheck.CodeExport, decl.Name, "methods can't be exported to C")
+		return exportC{}
+	}
+	if name == decl.Name.Name {
+		c.errorf(gxcheck.CodeExport, decl.Name, "C name of exported function must differ from its gx name")
+		return exportC{}
+	}
+	for i, nParams := 0, sig.Params().Len(); i < nParams; i++ {
+		param := sig.Params().At(i)
+		paramName := param.Name()
+		if paramName == "" || paramName == "_" {
+			paramName = "arg" + strconv.Itoa(i)
+		}
+		cParam, ok := c.genCParam(param.Type(), paramName)
+		if !ok {
+			c.errorf(gxcheck.CodeExport, decl.Name, "parameter %s of type %s can't be exported to C", paramName, param.Type())
+			continue
+		}
+		if structName, ok := c.cStructName(param.Type()); ok {
+			c.checkCStruct(decl, param.Type().(*types.Named), structName)
+		}
+		params = append(params, cParam.decls...)
+		args = append(args, cParam.arg)
+		body.WriteString(cParam.pre)
+		post.WriteString(cParam.post)
+		if cParam.note != "" {
+			notes = append(notes, cParam.note)
+		}
+	}
+	call := decl.Name.Name + "(" + strings.Join(args, ", ") + ")"
+	result := "void "
+	if sig.Results().Len() == 1 {
+		typ := sig.Results().At(0).Type()
+		if cType, ok := c.genCType(typ); ok {
+			result = cType
+			body.WriteString("auto result = " + call + ";\n")
+			body.WriteString(post.String())
+			body.WriteString("return result;\n")
+		} else if basic, ok := typ.(*types.Basic); ok && basic.Kind() == types.String {
+			params = append(params, "const char **result_data", "int *result_len")
+			body.WriteString("static gx::String result;\n")
+			body.WriteString("result = " + call + ";\n")
+			body.WriteString(post.String())
+			body.WriteString("*result_data = result;\n*result_len = gx::len(result);\n")
+			notes = append(notes, staticResultNote)
+		} else if structName, ok := c.cStructName(typ); ok {
+			c.checkCStruct(decl, typ.(*types.Named), structName)
+			params = append(params, structName+" *result")
+			body.WriteString("*result = " + call + ";\n")
+			body.WriteString(post.String())
+		} else if elemType, ok := c.sliceCElemType(typ); ok {
+			params = append(params, elemType+"**result_data", "int *result_len")
+			body.WriteString("static gx::Slice<" + trimFinalSpace(elemType) + "> result;\n")
+			body.WriteString("result = " + call + ";\n")
+			body.WriteString(post.String())
+			body.WriteString("*result_data = result.data;\n*result_len = result.size;\n")
+			notes = append(notes, staticResultNote)
+		} else {
+			c.errorf(gxcheck.CodeExport, decl.Name, "result of type %s can't be exported to C", typ)
+		}
+	} else {
+		body.WriteString(call + ";\n")
+		body.WriteString(post.String())
+	}
+	if len(params) == 0 {
+		params = append(params, "void")
+	}
+	return exportC{decl: result + name + "(" + strings.Join(params, ", ") + ")", body: body.String(), notes: notes}
+}
+
+const staticResultNote = "The result points into a static buffer of this function that the next call " +
+	"overwrites, which isn't thread-safe"
+
+func (c *compiler) sliceCElemType(typ types.Type) (string, bool) {
+	if slice, ok := typ.(*types.Slice); ok {
+		if _, ok := slice.Elem().(*types.Basic); ok {
+			return c.genCType(slice.Elem())
+		}
+	}
+	return "", false
+}
+
+// cStructField is a field of a struct defined in the C header
+type cStructField struct {
+	decl    string       // C declaration
+	name    string       // Name in C and C++
+	ref     *types.Named // Struct the field contains or points to, if any
+	byValue bool         // Whether ref is contained rather than pointed to
+}
+
+// genCFieldDecl returns the C declaration of a field of a struct passed by value
+func (c *compiler) genCFieldDecl(typ types.Type, declarator string) (cStructField, bool) {
+	if cType, ok := c.genCType(typ); ok {
+		field := cStructField{decl: cType + declarator}
+		if ptr, ok := typ.(*types.Pointer); ok {
+			field.ref, _ = ptr.Elem().(*types.Named)
+		}
+		return field, true
+	}
+	if structName, ok := c.cStructName(typ); ok {
+		return cStructField{decl: structName + " " + declarator, ref: typ.(*types.Named), byValue: true}, true
+	}
+	if array, ok := typ.(*types.Array); ok {
+		return c.genCFieldDecl(array.Elem(), declarator+"["+strconv.FormatInt(array.Len(), 10)+"]")
+	}
+	return cStructField{}, false
+}
+
+// cStructFields returns the fields of a struct passed to C by value, in the same order as in C++ so
+// that the layouts match. Embedded fields are left out of both. bad is the first field that has no
+// C equivalent, if any.
+func (c *compiler) cStructFields(named *types.Named) (fields []cStructField, bad *types.Var) {
+	structType := named.Underlying().(*types.Struct)
+	for i, nFields := 0, structType.NumFields(); i < nFields; i++ {
+		field := structType.Field(i)
+		if field.Embedded() {
+			continue
+		}
+		cField, ok := c.genCFieldDecl(field.Type(), field.Name())
+		if !ok {
+			if bad == nil {
+				bad = field
+			}
+			continue
+		}
+		cField.name = field.Name()
+		fields = append(fields, cField)
+	}
+	return fields, bad
+}
+
+// checkCStruct reports an error if a struct passed to C by value, or a struct it contains, has a
+// field without a C equivalent
+func (c *compiler) checkCStruct(decl *ast.FuncDecl, named *types.Named, structName string) {
+	fields, bad := c.cStructFields(named)
+	if bad != nil {
+		c.errorf(gxcheck.CodeExport, decl.Name, "struct %s can't be passed to C by value: field %s of type %s has no C equivalent",
+			structName, bad.Name(), bad.Type())
+		return
+	}
+	for _, field := range fields {
+		if field.byValue {
+			c.checkCStruct(decl, field.ref, field.ref.Obj().Name())
+		}
+	}
+}
+
+// cStructs returns the structs that exported functions refer to, which the C header declares, and
+// those passed by value, which it defines after the structs they contain
+func (c *compiler) cStructs(funcDecls []*ast.FuncDecl) (declared, defined []*types.Named) {
+	declaredVisited := make(map[*types.Named]bool)
+	definedVisited := make(map[*types.Named]bool)
+	declare := func(named *types.Named) {
+		if !declaredVisited[named] {
+			declaredVisited[named] = true
+			declared = append(declared, named)
+		}
+	}
+	var define func(named *types.Named)
+	define = func(named *types.Named) {
+		if definedVisited[named] {
+			return
+		}
+		definedVisited[named] = true
+		declare(named)
+		fields, _ := c.cStructFields(named)
+		for _, field := range fields {
+			if field.ref != nil && field.byValue {
+				define(field.ref)
+			} else if field.ref != nil {
+				declare(field.ref)
+			}
+		}
+		defined = append(defined, named)
+	}
+	for _, funcDecl := range funcDecls {
+		if _, ok := c.genExportsC[funcDecl]; ok {
+			sig := c.types.Defs[funcDecl.Name].Type().(*types.Signature)
+			namedTypes(sig, func(obj types.Object) {
+				if _, ok := c.cStructName(obj.Type()); ok {
+					declare(obj.Type().(*types.Named))
+				}
+			})
+			for _, tuple := range []*types.Tuple{sig.Params(), sig.Results()} {
+				for i, n := 0, tuple.Len(); i < n; i++ {
+					if _, ok := c.cStructName(tuple.At(i).Type()); ok {
+						define(tuple.At(i).Type().(*types.Named))
+					}
+				}
+			}
+		}
+	}
+	return declared, defined
+}
+
+// genCStructDefn returns the definition of a struct passed to C by value
+func (c *compiler) genCStructDefn(named *types.Named) string {
+	builder := &strings.Builder{}
+	builder.WriteString("struct " + named.Obj().Name() + " {\n")
+	fields, _ := c.cStructFields(named)
+	for _, field := range fields {
+		builder.WriteString("  " + field.decl + ";\n")
+	}
+	builder.WriteString("};\n")
+	return builder.String()
+}
+
+// writeCStructChecks writes a copy of the C definitions of structs passed by value and checks that
+// the C++ structs have the same layout
+func (c *compiler) writeCStructChecks(funcDecls []*ast.FuncDecl) {
+	_, defined := c.cStructs(funcDecls)
+	if len(defined) == 0 {
+		return
+	}
+	c.write("\nnamespace gx_c {\n")
+	for _, named := range defined {
+		c.write(c.genCStructDefn(named))
+	}
+	c.write("}\n")
+	for _, named := range defined {
+		name := named.Obj().Name()
+		c.write("static_assert(sizeof(" + name + ") == sizeof(gx_c::" + name + ") && alignof(" + name +
+			") == alignof(gx_c::" + name + "), \"layout of " + name + " must match the C header\");\n")
+		fields, _ := c.cStructFields(named)
+		for _, field := range fields {
+			c.write("static_assert(offsetof(" + name + ", " + field.name + ") == offsetof(gx_c::" + name + ", " +
+				field.name + "));\n")
+		}
+	}
+}
+
+// writeExportsC writes the `extern "C"` wrappers of exported functions
+func (c *compiler) writeExportsC(funcDecls []*ast.FuncDecl) {
+	c.writeCStructChecks(funcDecls)
+	for _, funcDecl := range funcDecls {
+		if export, ok := c.genExportsC[funcDecl]; ok {
+			c.write("\n")
+			c.mapLine(funcDecl.Pos())
+			c.write("extern \"C\" GX_EXPORT_C ")
+			c.write(export.decl)
+			c.write(" {\n")
+			c.indent++
+			for _, line := range strings.SplitAfter(export.body, "\n") {
+				if line != "" {
+					c.write(line)
+				}
+			}
+			c.indent--
+			c.write("}\n")
+		}
+	}
+}
+
+// genHeaderC generates a C header declaring the wrappers of exported functions. Structs passed by
+// value are defined with the layout of their C++ counterparts, other structs they refer to are
+// declared as opaque.
+func (c *compiler) genHeaderC(funcDecls []*ast.FuncDecl) string {
+	declared, defined := c.cStructs(funcDecls)
+	builder := &strings.Builder{}
+	builder.WriteString("#pragma once\n\n")
+	builder.WriteString("#include <stdbool.h>\n\n")
+	builder.WriteString("#ifdef __cplusplus\nextern \"C\" {\n#endif\n\n")
+	for _, named := range declared {
+		builder.WriteString("typedef struct " + named.Obj().Name() + " " + named.Obj().Name() + ";\n")
+	}
+	if len(declared) > 0 {
+		builder.WriteString("\n")
+	}
+	for _, named := range defined {
+		builder.WriteString(c.genCStructDefn(named))
+		builder.WriteString("\n")
+	}
+	for _, funcDecl := range funcDecls {
+		if export, ok := c.genExportsC[funcDecl]; ok {
+			for _, note := range export.notes {
+				builder.WriteString("// " + note + "\n")
+			}
+			builder.WriteString(export.decl)
+			builder.WriteString(";\n")
+		}
+	}
+	builder.WriteString("\n#ifdef __cplusplus\n}\n#endif\n")
+	return builder.String()
+}
+
+//
+// Dead code elimination
+//
+
+// methodKey identifies a method by the uninstantiated type it's declared on, so that calls on
+// instances of generic types find the declaration
+type methodKey struct {
+	typeName types.Object
+	name     string
+}
+
+func recvTypeName(sig *types.Signature) types.Object {
+	typ := sig.Recv().Type()
+	if ptr, ok := typ.(*types.Pointer); ok {
+		typ = ptr.Elem()
+	}
+	if named, ok := typ.(*types.Named); ok {
+		return named.Origin().Obj()
+	}
+	return nil
+}
+
+// prune removes declarations not reachable from the roots: `main` or the tests, functions and
+// variables marked `//gx:export` or `//gx:export_c`, types exported in the header along with their methods, and
+// variables whose initializers call functions. Methods called through type parameters keep all methods of that
+// name. Removed declarations are described in `c.removed`.
+func (c *compiler) prune(typeSpecs []*ast.TypeSpec, valueSpecs []*ast.ValueSpec, funcDecls []*ast.FuncDecl,
+	exports map[types.Object]bool, exportedDecls map[ast.Node]bool, tests []*ast.FuncDecl) ([]*ast.TypeSpec, []*ast.ValueSpec, []*ast.FuncDecl) {
+	objTypeSpecs := make(map[types.Object]*ast.TypeSpec)
+	for _, typeSpec := range typeSpecs {
+		objTypeSpecs[c.types.Defs[typeSpec.Name]] = typeSpec
+	}
+	objValueSpecs := make(map[types.Object]*ast.ValueSpec)
+	for _, valueSpec := range valueSpecs {
+		for _, name := range valueSpec.Names {
+			objValueSpecs[c.types.Defs[name]] = valueSpec
+		}
+	}
+	objFuncDecls := make(map[types.Object]*ast.FuncDecl)
+	methodDecls := make(map[methodKey]*ast.FuncDecl)
+	methodDeclsByName := make(map[string][]*ast.FuncDecl)
+	for _, funcDecl := range funcDecls {
+		obj := c.types.Defs[funcDecl.Name]
+		if sig := obj.Type().(*types.Signature); sig.Recv() != nil {
+			methodDecls[methodKey{recvTypeName(sig), obj.Name()}] = funcDecl
+			methodDeclsByName[obj.Name()] = append(methodDeclsByName[obj.Name()], funcDecl)
+		} else {
+			objFuncDecls[obj] = funcDecl
+		}
+	}
+
+	// Visit declarations reachable from the roots
+	reached := make(map[ast.Node]bool)
+	var queue []ast.Node
+	reach := func(node ast.Node) {
+		if !reached[node] {
+			reached[node] = true
+			queue = append(queue, node)
+		}
+	}
+	for _, funcDecl := range funcDecls {
+		obj := c.types.Defs[funcDecl.Name]
+		isMain := obj.Pkg().Name() == "main" && obj.Name() == "main" && funcDecl.Recv == nil
+		if _, exportedC := c.genExportsC[funcDecl]; (isMain && !c.test) || exportedDecls[funcDecl] || exportedC {
+			reach(funcDecl)
+		} else if sig := obj.Type().(*types.Signature); sig.Recv() != nil && exports[recvTypeName(sig)] {
+			reach(funcDecl)
+		}
+	}
+	for _, test := range tests {
+		reach(test)
+	}
+	for _, typeSpec := range typeSpecs {
+		if exports[c.types.Defs[typeSpec.Name]] {
+			reach(typeSpec)
+		}
+	}
+	for _, valueSpec := range valueSpecs {
+		if exportedDecls[valueSpec] {
+			reach(valueSpec)
+		}
+		for _, value := range valueSpec.Values {
+			ast.Inspect(value, func(node ast.Node) bool {
+				if call, ok := node.(*ast.CallExpr); ok && !c.types.Types[call.Fun].IsType() {
+					reach(valueSpec)
+				}
+				return true
+			})
+		}
+	}
+	for len(queue) > 0 {
+		node := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		ast.Inspect(node, func(node ast.Node) bool {
+			ident, ok := node.(*ast.Ident)
+			if !ok {
+				return true
+			}
+			obj := c.types.Uses[ident]
+			if typeSpec, ok := objTypeSpecs[obj]; ok {
+				reach(typeSpec)
+			} else if valueSpec, ok := objValueSpecs[obj]; ok {
+				reach(valueSpec)
+			} else if funcDecl, ok := objFuncDecls[obj]; ok {
+				reach(funcDecl)
+			} else if fun, ok := obj.(*types.Func); ok {
+				if sig := fun.Type().(*types.Signature); sig.Recv() != nil {
+					if _, ok := sig.Recv().Type().Underlying().(*types.Interface); ok {
+						for _, funcDecl := range methodDeclsByName[fun.Name()] {
+							reach(funcDecl)
+						}
+					} else if funcDecl, ok := methodDecls[methodKey{recvTypeName(sig), fun.Name()}]; ok {
+						reach(funcDecl)
+					}
+				}
+			}
+			return true
+		})
+	}
+
+	// Keep reached declarations in order
+	type removal struct {
+		pos         token.Pos
+		description string
+	}
+	var removals []removal
+	var keptTypeSpecs []*ast.TypeSpec
+	for _, typeSpec := range typeSpecs {
+		if reached[typeSpec] {
+			keptTypeSpecs = append(keptTypeSpecs, typeSpec)
+		} else {
+			removals = append(removals, removal{typeSpec.Pos(), "type " + typeSpec.Name.Name})
+		}
+	}
+	var keptValueSpecs []*ast.ValueSpec
+	for _, valueSpec := range valueSpecs {
+		if reached[valueSpec] {
+			keptValueSpecs = append(keptValueSpecs, valueSpec)
+		} else {
+			for _, name := range valueSpec.Names {
+				kind := "var "
+				if name.Obj != nil && name.Obj.Kind == ast.Con {
+					kind = "const "
+				}
+				removals = append(removals, removal{name.Pos(), kind + name.Name})
+			}
+		}
+	}
+	var keptFuncDecls []*ast.FuncDecl
+	for _, funcDecl := range funcDecls {
+		if reached[funcDecl] {
+			keptFuncDecls = append(keptFuncDecls, funcDecl)
+		} else {
+			name := funcDecl.Name.Name
+			if sig := c.types.Defs[funcDecl.Name].Type().(*types.Signature); sig.Recv() != nil {
+				name = recvTypeName(sig).Name() + "." + name
+			}
+			removals = append(removals, removal{funcDecl.Pos(), "func " + name})
+		}
+	}
+	sort.SliceStable(removals, func(i, j int) bool {
+		a, b := c.fileSet.Position(removals[i].pos), c.fileSet.Position(removals[j].pos)
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Offset < b.Offset
+	})
+	for _, removal := range removals {
+		c.removed = append(c.removed, c.fileSet.Position(removal.pos).String()+": "+removal.description)
+	}
+	return keptTypeSpecs, keptValueSpecs, keptFuncDecls
+}
+
+//
+// Tests
+//
+
+const testingPkgPath = "github.com/nikki93/gx/testing"
+
+func isTestFile(filename string) bool {
+	return strings.HasSuffix(filename, "_test.gx.go")
+}
+
+// collectTests returns the `TestXxx` functions declared in test files of the main package
+func (c *compiler) collectTests(funcDecls []*ast.FuncDecl) []*ast.FuncDecl {
+	var tests []*ast.FuncDecl
+	for _, funcDecl := range funcDecls {
+		name := funcDecl.Name.Name
+		if funcDecl.Recv != nil || !strings.HasPrefix(name, "Test") || !isTestFile(c.fileSet.Position(funcDecl.Pos()).Filename) {
+			continue
+		}
+		if rest := name[len("Test"):]; rest != "" {
+			if r, _ := utf8.DecodeRuneInString(rest); unicode.IsLower(r) {
+				continue // Not a test, like in Go
+			}
+		}
+		sig := c.types.Defs[funcDecl.Name].Type().(*types.Signature)
+		isT := false
+		if sig.Params().Len() == 1 {
+			if ptr, ok := sig.Params().At(0).Type().(*types.Pointer); ok {
+				if named, ok := ptr.Elem().(*types.Named); ok {
+					obj := named.Obj()
+					isT = obj.Name() == "T" && obj.Pkg() != nil && obj.Pkg().Path() == testingPkgPath
+				}
+			}
+		}
+		if !isT || sig.Results().Len() != 0 || sig.TypeParams().Len() != 0 {
+			c.errorf(gxcheck.CodeTestSignature, funcDecl.Name, "wrong signature for %s, must be: func %s(t *testing.T)", name, name)
+			continue
+		}
+		tests = append(tests, funcDecl)
+	}
+	return tests
+}
+
+// writeTestRunner writes a `main` that runs the given tests
+func (c *compiler) writeTestRunner(tests []*ast.FuncDecl) {
+	c.write("\n\n")
+	c.write("//\n// Test runner\n//\n\n")
+	c.write("int main(int argc, char **argv) {\n")
+	c.indent++
+	if c.recover {
+		c.write("gx::testing::caughtPanic = gx::caughtPanic;\n")
+	}
+	c.write("return gx::testing::runTests(argc, argv, {\n")
+	c.indent++
+	for _, test := range tests {
+		c.write("{ \"")
+		c.write(test.Name.Name)
+		c.write("\", ")
+		c.write(test.Name.Name)
+		c.write(" },\n")
+	}
+	c.indent--
+	c.write("});\n")
+	c.indent--
+	c.write("}\n")
+}
+
+// unitFileName returns the name of one of a unit's output files
+func (c *compiler) unitFileName(u *unit, suffix string) string {
+	if u.name == "" {
+		return c.outputName + suffix
+	}
+	return c.outputName + "." + u.name + suffix
+}
+
+//
+// Cache
+//
+
+// cacheFormat is changed when the format of cache entries changes
+const cacheFormat = "gx-cache-1"
+
+// cacheEntry holds code generated for a package, reused by later compilations of the package with
+// the same key. Fragments are keyed by the position of their declaration in its file, which is
+// stable since the key covers the package's sources. Function declarations aren't cached since
+// generating them also records renames of methods that calls in other packages need.
+type cacheEntry struct {
+	TypeDecls  map[string]string     `json:"typeDecls"`
+	TypeDefns  map[string]string     `json:"typeDefns"`
+	TypeMetas  map[string]string     `json:"typeMetas"`
+	FuncBodies map[string]cachedBody `json:"funcBodies"`
+}
+
+// cachedBody is the generated code of a function body, with its mappings to Go positions
+type cachedBody struct {
+	Code  string       `json:"code"`
+	Lines []cachedLine `json:"lines"`
+}
+
+type cachedLine struct {
+	Line   int    `json:"line"` // Relative to the first line of the body
+	File   string `json:"file"`
+	Offset int    `json:"offset"`
+}
+
+var (
+	compilerHashOnce sync.Once
+	compilerHash     string
+)
+
+// cacheCompilerHash identifies the compiler in cache keys, by hashing the running executable so
+// that rebuilding gx invalidates the cache
+func cacheCompilerHash() string {
+	compilerHashOnce.Do(func() {
+		hash := sha256.New()
+		if path, err := os.Executable(); err == nil {
+			if f, err := os.Open(path); err == nil {
+				io.Copy(hash, f)
+				f.Close()
+			}
+		}
+		compilerHash = hex.EncodeToString(hash.Sum(nil))
+	})
+	return compilerHash
+}
+
+// cacheKeys computes the key of each package from its sources, the keys of the packages it imports,
+// the compiler and the options affecting generated code. Packages whose sources can't be read
+// aren't cached.
+func (c *compiler) cacheKeys(pkgs []*packages.Package) map[*packages.Package]string {
+	keys := make(map[*packages.Package]string)
+	compiled := make(map[*packages.Package]bool)
+	for _, pkg := range pkgs {
+		compiled[pkg] = true
+	}
+	var overlay map[string][]byte
+	if c.packagesConfig != nil {
+		overlay = c.packagesConfig.Overlay
+	}
+	visited := make(map[*packages.Package]bool)
+	var visit func(pkg *packages.Package) (string, bool)
+	visit = func(pkg *packages.Package) (string, bool) {
+		if key, ok := keys[pkg]; ok || visited[pkg] {
+			return key, ok
+		}
+		visited[pkg] = true
+		hash := sha256.New()
+		fmt.Fprintf(hash, "%s %s %s\n", cacheFormat, cacheCompilerHash(), pkg.PkgPath)
+		fmt.Fprintf(hash, "recover=%v noChecks=%v line=%v separate=%v test=%v\n",
+			c.recover, c.noChecks, c.lineDirectives, c.separate, c.test)
+		for _, file := range c.files[pkg] {
+			filename := c.fileSet.Position(file.Pos()).Filename
+			contents, ok := overlay[filename]
+			if !ok {
+				var err error
+				if contents, err = os.ReadFile(filename); err != nil {
+					return "", false
+				}
+			}
+			fmt.Fprintf(hash, "file %s %d\n", filename, len(contents))
+			hash.Write(contents)
+		}
+		var impPaths []string
+		for path, imp := range pkg.Imports {
+			if compiled[imp] {
+				impPaths = append(impPaths, path)
+			}
+		}
+		sort.Strings(impPaths)
+		for _, path := range impPaths {
+			impKey, ok := visit(pkg.Imports[path])
+			if !ok {
+				return "", false
+			}
+			fmt.Fprintf(hash, "import %s %s\n", path, impKey)
+		}
+		key := hex.EncodeToString(hash.Sum(nil))
+		keys[pkg] = key
+		return key, true
+	}
+	for _, pkg := range pkgs {
+		visit(pkg)
+	}
+	return keys
+}
+
+// cacheDeclKey names a declaration in a cache entry
+func (c *compiler) cacheDeclKey(node ast.Node) string {
+	position := c.fileSet.PositionFor(node.Pos(), false)
+	return filepath.Base(position.Filename) + ":" + strconv.Itoa(position.Offset)
+}
+
+// loadCache reads cache entries of packages and fills in the fragments they hold, returning the keys
+// of packages that missed
+func (c *compiler) loadCache(pkgs []*packages.Package, typeSpecs []*ast.TypeSpec, funcDecls []*ast.FuncDecl) map[*packages.Package]string {
+	keys := c.cacheKeys(pkgs)
+	misses := make(map[*packages.Package]string)
+	for _, pkg := range pkgs {
+		key, ok := keys[pkg]
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(c.cacheDir, key+".json"))
+		if err != nil {
+			misses[pkg] = key
+			continue
+		}
+		entry := &cacheEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			misses[pkg] = key
+			continue
+		}
+		c.cacheHits[pkg] = entry
+	}
+	files := make(map[string]*token.File)
+	for pkg := range c.cacheHits {
+		for _, file := range c.files[pkg] {
+			tokenFile := c.fileSet.File(file.Pos())
+			files[tokenFile.Name()] = tokenFile
+		}
+	}
+	for _, typeSpec := range typeSpecs {
+		if entry, ok := c.cacheHits[c.declPkgs[typeSpec]]; ok {
+			key := c.cacheDeclKey(typeSpec)
+			if typeDecl, ok := entry.TypeDecls[key]; ok {
+				c.genTypeDecls[typeSpec] = typeDecl
+			}
+			if typeDefn, ok := entry.TypeDefns[key]; ok {
+				c.genTypeDefns[typeSpec] = typeDefn
+			}
+			if typeMeta, ok := entry.TypeMetas[key]; ok {
+				c.genTypeMetas[typeSpec] = typeMeta
+			}
+		}
+	}
+	for _, funcDecl := range funcDecls {
+		if entry, ok := c.cacheHits[c.declPkgs[funcDecl]]; ok {
+			if cached, ok := entry.FuncBodies[c.cacheDeclKey(funcDecl)]; ok {
+				body := funcBody{code: cached.Code}
+				for _, line := range cached.Lines {
+					if file, ok := files[line.File]; ok && line.Offset <= file.Size() {
+						body.lineMap = append(body.lineMap, lineMapping{ccLine: line.Line, pos: file.Pos(line.Offset)})
+					}
+				}
+				c.genFuncBodies[funcDecl] = body
+			}
+		}
+	}
+	return misses
+}
+
+// saveCache writes cache entries for packages that missed, once code was generated without errors
+func (c *compiler) saveCache(misses map[*packages.Package]string, typeSpecs []*ast.TypeSpec, funcDecls []*ast.FuncDecl) {
+	entries := make(map[*packages.Package]*cacheEntry)
+	for pkg := range misses {
+		entries[pkg] = &cacheEntry{
+			TypeDecls:  make(map[string]string),
+			TypeDefns:  make(map[string]string),
+			TypeMetas:  make(map[string]string),
+			FuncBodies: make(map[string]cachedBody),
+		}
+	}
+	for _, typeSpec := range typeSpecs {
+		if entry, ok := entries[c.declPkgs[typeSpec]]; ok {
+			key := c.cacheDeclKey(typeSpec)
+			if typeDecl, ok := c.genTypeDecls[typeSpec]; ok {
+				entry.TypeDecls[key] = typeDecl
+			}
+			if typeDefn, ok := c.genTypeDefns[typeSpec]; ok {
+				entry.TypeDefns[key] = typeDefn
+			}
+			if typeMeta, ok := c.genTypeMetas[typeSpec]; ok {
+				entry.TypeMetas[key] = typeMeta
+			}
+		}
+	}
+	for _, funcDecl := range funcDecls {
+		if entry, ok := entries[c.declPkgs[funcDecl]]; ok {
+			if body, ok := c.genFuncBodies[funcDecl]; ok {
+				cached := cachedBody{Code: body.code}
+				for _, mapping := range body.lineMap {
+					position := c.fileSet.PositionFor(mapping.pos, false)
+					cached.Lines = append(cached.Lines, cachedLine{Line: mapping.ccLine, File: position.Filename, Offset: position.Offset})
+				}
+				entry.FuncBodies[c.cacheDeclKey(funcDecl)] = cached
+			}
+		}
+	}
+	if err := os.MkdirAll(c.cacheDir, 0755); err != nil {
+		return
+	}
+	for pkg, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			continue
+		}
+		// Write to a temporary file and rename so concurrent builds never read partial entries
+		path := filepath.Join(c.cacheDir, misses[pkg]+".json")
+		if f, err := os.CreateTemp(c.cacheDir, "tmp-*"); err == nil {
+			_, writeErr := f.Write(data)
+			if closeErr := f.Close(); writeErr != nil || closeErr != nil || os.Rename(f.Name(), path) != nil {
+				os.Remove(f.Name())
+			}
+		}
+	}
+}
+
+//
+// Top-level
+//
+
+var exportRe = regexp.MustCompile(`^//gx:export\s*$`)
+
+// hasExportDirective reports whether a declaration is marked with `//gx:export`
+func hasExportDirective(doc *ast.CommentGroup) bool {
+	if doc != nil {
+		for _, comment := range doc.List {
+			if exportRe.MatchString(comment.Text) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// namedTypes calls fn with the type name of each named type a type refers to
+func namedTypes(typ types.Type, fn func(obj types.Object)) {
+	switch typ := typ.(type) {
+	case *types.Named:
+		fn(typ.Origin().Obj())
+		if typeArgs := typ.TypeArgs(); typeArgs != nil {
+			for i, nTypeArgs := 0, typeArgs.Len(); i < nTypeArgs; i++ {
+				namedTypes(typeArgs.At(i), fn)
+			}
+		}
+	case *types.Pointer:
+		namedTypes(typ.Elem(), fn)
+	case *types.Slice:
+		namedTypes(typ.Elem(), fn)
+	case *types.Array:
+		namedTypes(typ.Elem(), fn)
+	case *types.Signature:
+		for _, tuple := range []*types.Tuple{typ.Params(), typ.Results()} {
+			for i, n := 0, tuple.Len(); i < n; i++ {
+				namedTypes(tuple.At(i).Type(), fn)
+			}
+		}
+	}
+}
+
+func (c *compiler) compile() {
+	// Initialize maps
+	c.externs = make(map[types.Object]string)
+	c.methodRenames = make(map[types.Object]string)
+	c.methodFieldTags = make(map[types.Object]string)
+	c.genTypeExprs = make(map[types.Type]string)
+	c.genTypeDecls = make(map[*ast.TypeSpec]string)
+	c.genTypeDefns = make(map[*ast.TypeSpec]string)
+	c.genTypeMetas = make(map[*ast.TypeSpec]string)
+	c.genFuncDecls = make(map[*ast.FuncDecl]string)
+	c.genMutex = &sync.Mutex{}
+	c.genFuncBodies = make(map[*ast.FuncDecl]funcBody)
+	c.declPkgs = make(map[ast.Node]*packages.Package)
+	c.globalAccesses = make(map[*ast.FuncDecl]globalAccess)
+	c.funcDeclsByPos = make(map[token.Pos]*ast.FuncDecl)
+
+	// Initialize builders
+	c.outputCC = &strings.Builder{}
+	c.outputHH = &strings.Builder{}
+
+	// Check packages
+	loadPkgs := c.pkgs
+	if len(loadPkgs) == 0 {
+		return
+	}
+	packages.Visit(loadPkgs, nil, func(pkg *packages.Package) {
+		for _, err := range pkg.Errors {
+			c.goErrorf(err.Pos, "%s", err.Msg)
+		}
+	})
+	if c.errored() {
+		return
+	}
+	c.fileSet = loadPkgs[0].Fset
+	genStart := time.Now()
+	defer c.logTime("generating code", genStart)
+
+	// Collect packages and their files. Test files are only compiled in the main package when
+	// testing, and packages only they import are skipped otherwise. Files are visited in name order
+	// and packages sorted by path so that output doesn't depend on load order.
+	var pkgs []*packages.Package
+	c.files = make(map[*packages.Package][]*ast.File)
+	{
+		visited := make(map[*packages.Package]bool)
+		var visit func(pkg *packages.Package, root bool)
+		visit = func(pkg *packages.Package, root bool) {
+			if !visited[pkg] {
+				visited[pkg] = true
+				files := append([]*ast.File{}, pkg.Syntax...)
+				sort.SliceStable(files, func(i, j int) bool {
+					return c.fileSet.Position(files[i].Pos()).Filename < c.fileSet.Position(files[j].Pos()).Filename
+				})
+				for _, file := range files {
+					if !isTestFile(c.fileSet.Position(file.Pos()).Filename) || (c.test && root) {
+						c.files[pkg] = append(c.files[pkg], file)
+						for _, spec := range file.Imports {
+							if path, err := strconv.Unquote(spec.Path.Value); err == nil {
+								if dep, ok := pkg.Imports[path]; ok {
+									visit(dep, false)
+								}
+							}
+						}
+					}
+				}
+				pkgs = append(pkgs, pkg)
+				if pkg.Fset != c.fileSet {
+					c.errorf(gxcheck.CodeInternal, span{}, "internal error: filesets differ")
+				}
+			}
+		}
+		for _, pkg := range loadPkgs {
+			visit(pkg, true)
+		}
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		if pkgs[i].PkgPath != pkgs[j].PkgPath {
+			return pkgs[i].PkgPath < pkgs[j].PkgPath
+		}
+		return pkgs[i].ID < pkgs[j].ID
+	})
+
+	// Collect types info
+	c.types = &types.Info{
+		Types:      make(map[ast.Expr]types.TypeAndValue),
+		Instances:  make(map[*ast.Ident]types.Instance),
+		Defs:       make(map[*ast.Ident]types.Object),
+		Uses:       make(map[*ast.Ident]types.Object),
+		Implicits:  make(map[ast.Node]types.Object),
+		Selections: make(map[*ast.SelectorExpr]*types.Selection),
+		Scopes:     make(map[ast.Node]*types.Scope),
 	}
 	for _, pkg := range pkgs {
 		for k, v := range pkg.TypesInfo.Types {
@@ -1095,7 +3004,7 @@ func (c *Compiler) compile() {
 			return ""
 		}
 		for _, pkg := range pkgs {
-			for _, file := range pkg.Syntax {
+			for _, file := range c.files[pkg] {
 				fileExt := ""
 				if len(file.Comments) > 0 {
 					fileExt = parseDirective(externsRe, file.Comments[0])
@@ -1158,6 +3067,14 @@ func (c *Compiler) compile() {
 				}
 			}
 		}
+		c.externsByPos = make(map[token.Pos]string)
+		for obj, ext := range c.externs {
+			if v, ok := obj.(*types.Var); ok && v.IsField() {
+				c.externsByPos[obj.Pos()] = ext
+			} else if sig, ok := obj.Type().(*types.Signature); ok && sig.Recv() != nil {
+				c.externsByPos[obj.Pos()] = ext
+			}
+		}
 	}
 
 	// Collect top-level decls and exports in output order
@@ -1166,11 +3083,13 @@ func (c *Compiler) compile() {
 	var funcDecls []*ast.FuncDecl
 	exports := make(map[types.Object]bool)
 	behaviors := make(map[types.Object]bool)
+	exportedDecls := make(map[ast.Node]bool) // Functions and value specs marked `//gx:export`
+	exportCNames := make(map[*ast.FuncDecl]string)
 	{
 		objTypeSpecs := make(map[types.Object]*ast.TypeSpec)
 		objValueSpecs := make(map[types.Object]*ast.ValueSpec)
 		for _, pkg := range pkgs {
-			for _, file := range pkg.Syntax {
+			for _, file := range c.files[pkg] {
 				for _, decl := range file.Decls {
 					switch decl := decl.(type) {
 					case *ast.GenDecl:
@@ -1178,66 +3097,73 @@ func (c *Compiler) compile() {
 							switch spec := spec.(type) {
 							case *ast.TypeSpec:
 								objTypeSpecs[c.types.Defs[spec.Name]] = spec
+								c.declPkgs[spec] = pkg
 							case *ast.ValueSpec:
 								for _, name := range spec.Names {
 									objValueSpecs[c.types.Defs[name]] = spec
 								}
 							}
 						}
+					case *ast.FuncDecl:
+						c.declPkgs[decl] = pkg
+						c.funcDeclsByPos[decl.Name.Pos()] = decl
 					}
 				}
 			}
 		}
 		typeSpecVisited := make(map[*ast.TypeSpec]bool)
 		valueSpecVisited := make(map[*ast.ValueSpec]bool)
+		var visitTypeSpec func(typeSpec *ast.TypeSpec, export bool)
+		visitTypeSpec = func(typeSpec *ast.TypeSpec, export bool) {
+			if _, ok := c.externs[c.types.Defs[typeSpec.Name]]; ok {
+				return
+			}
+			obj := c.types.Defs[typeSpec.Name]
+			visited := typeSpecVisited[typeSpec]
+			if visited && !(export && !exports[obj]) {
+				return
+			}
+			if !visited {
+				typeSpecVisited[typeSpec] = true
+				if structType, ok := typeSpec.Type.(*ast.StructType); ok {
+					for _, field := range structType.Fields.List {
+						if field.Names == nil {
+							if ident, ok := field.Type.(*ast.Ident); ok && ident.Name == "Behavior" {
+								behaviors[obj] = true
+								export = true
+							}
+						}
+					}
+				}
+			}
+			if export {
+				exports[obj] = true
+			}
+			ast.Inspect(typeSpec.Type, func(node ast.Node) bool {
+				if ident, ok := node.(*ast.Ident); ok {
+					if typeSpec, ok := objTypeSpecs[c.types.Uses[ident]]; ok {
+						visitTypeSpec(typeSpec, export)
+					}
+				}
+				return true
+			})
+			if !visited {
+				typeSpecs = append(typeSpecs, typeSpec)
+			}
+		}
 		for _, pkg := range pkgs {
-			for _, file := range pkg.Syntax {
+			for _, file := range c.files[pkg] {
 				for _, decl := range file.Decls {
 					switch decl := decl.(type) {
 					case *ast.GenDecl:
 						for _, spec := range decl.Specs {
 							switch spec := spec.(type) {
 							case *ast.TypeSpec:
-								var visitTypeSpec func(typeSpec *ast.TypeSpec, export bool)
-								visitTypeSpec = func(typeSpec *ast.TypeSpec, export bool) {
-									if _, ok := c.externs[c.types.Defs[typeSpec.Name]]; ok {
-										return
-									}
-									obj := c.types.Defs[typeSpec.Name]
-									visited := typeSpecVisited[typeSpec]
-									if visited && !(export && !exports[obj]) {
-										return
-									}
-									if !visited {
-										typeSpecVisited[typeSpec] = true
-										if structType, ok := typeSpec.Type.(*ast.StructType); ok {
-											for _, field := range structType.Fields.List {
-												if field.Names == nil {
-													if ident, ok := field.Type.(*ast.Ident); ok && ident.Name == "Behavior" {
-														behaviors[obj] = true
-														export = true
-													}
-												}
-											}
-										}
-									}
-									if export {
-										exports[obj] = true
-									}
-									ast.Inspect(typeSpec.Type, func(node ast.Node) bool {
-										if ident, ok := node.(*ast.Ident); ok {
-											if typeSpec, ok := objTypeSpecs[c.types.Uses[ident]]; ok {
-												visitTypeSpec(typeSpec, export)
-											}
-										}
-										return true
-									})
-									if !visited {
-										typeSpecs = append(typeSpecs, typeSpec)
-									}
-								}
 								visitTypeSpec(spec, false)
 							case *ast.ValueSpec:
+								if hasExportDirective(decl.Doc) || hasExportDirective(spec.Doc) {
+									exportedDecls[spec] = true
+								}
 								var visitValueSpec func(valueSpec *ast.ValueSpec)
 								visitValueSpec = func(valueSpec *ast.ValueSpec) {
 									if valueSpecVisited[valueSpec] {
@@ -1266,29 +3192,117 @@ func (c *Compiler) compile() {
 							}
 						}
 					case *ast.FuncDecl:
+						if c.test && decl.Recv == nil && decl.Name.Name == "main" && pkg.Name == "main" {
+							continue // Replaced by the test runner
+						}
 						if _, ok := c.externs[c.types.Defs[decl.Name]]; !ok {
 							funcDecls = append(funcDecls, decl)
+							if hasExportDirective(decl.Doc) {
+								exportedDecls[decl] = true
+							}
+							if name := exportCName(decl.Doc); name != "" {
+								exportCNames[decl] = name
+							}
 						}
 					}
 				}
 			}
 		}
+
+		// Export types that exported functions and variables refer to, including receivers
+		exportType := func(obj types.Object) {
+			if typeSpec, ok := objTypeSpecs[obj]; ok {
+				visitTypeSpec(typeSpec, true)
+			}
+		}
+		for _, funcDecl := range funcDecls {
+			if exportedDecls[funcDecl] {
+				sig := c.types.Defs[funcDecl.Name].Type().(*types.Signature)
+				if sig.Recv() != nil {
+					namedTypes(sig.Recv().Type(), exportType)
+				}
+				namedTypes(sig, exportType)
+			}
+		}
+		for _, valueSpec := range valueSpecs {
+			if exportedDecls[valueSpec] {
+				for _, name := range valueSpec.Names {
+					namedTypes(c.types.TypeOf(name), exportType)
+				}
+			}
+		}
+	}
+
+	// Check for code outside the supported subset
+	for _, pkg := range pkgs {
+		gxcheck.Check(c.types, c.files[pkg], c.errorf)
+	}
+	if c.errored() {
+		return
+	}
+
+	// Check exported functions, which must be declared without templates to be called from C++,
+	// and generate wrappers of those exported to C
+	c.genExportsC = make(map[*ast.FuncDecl]exportC)
+	for _, funcDecl := range funcDecls {
+		_, exportedC := exportCNames[funcDecl]
+		if (exportedDecls[funcDecl] || exportedC) && c.isTemplate(funcDecl) {
+			c.errorf(gxcheck.CodeExport, funcDecl.Name, "exported function can't be generic or take function parameters")
+		} else if exportedC {
+			c.genExportsC[funcDecl] = c.genExportC(funcDecl, exportCNames[funcDecl])
+		}
+	}
+	if c.errored() {
+		return
+	}
+
+	// Collect tests
+	var tests []*ast.FuncDecl
+	if c.test {
+		tests = c.collectTests(funcDecls)
+		if c.errored() {
+			return
+		}
+	}
+
+	// Remove unreachable declarations
+	if !c.keepAll {
+		typeSpecs, valueSpecs, funcDecls = c.prune(typeSpecs, valueSpecs, funcDecls, exports, exportedDecls, tests)
 	}
 
 	// `#include`s
-	var includes string
+	var includes, defines string
+	pkgIncludes := make(map[*packages.Package][]string)
 	{
 		re := regexp.MustCompile(`//gx:include (.*)`)
 		visited := make(map[string]bool)
 		builder := &strings.Builder{}
+		if c.recover {
+			builder.WriteString("#define GX_RECOVER\n")
+		}
+		if c.noChecks {
+			builder.WriteString("#define GX_NO_CHECKS\n")
+		}
+		defines = builder.String()
+		visitedDirs := make(map[string]bool)
+		var quotedIncludes []string
 		for _, pkg := range pkgs {
-			for _, file := range pkg.Syntax {
+			for _, file := range c.files[pkg] {
+				c.inputFiles = append(c.inputFiles, c.fileSet.Position(file.Pos()).Filename)
 				if len(file.Comments) > 0 {
 					for _, comment := range file.Comments[0].List {
 						if matches := re.FindStringSubmatch(comment.Text); len(matches) > 1 {
+							if dir := filepath.Dir(c.fileSet.Position(file.Pos()).Filename); !visitedDirs[dir] {
+								visitedDirs[dir] = true
+								c.includeDirs = append(c.includeDirs, dir)
+							}
 							include := matches[1]
+							pkgIncludes[pkg] = append(pkgIncludes[pkg], include)
 							if !visited[include] {
 								visited[include] = true
+								if strings.HasPrefix(include, "\"") {
+									quotedIncludes = append(quotedIncludes, strings.Trim(include, "\""))
+								}
 								builder.WriteString("#include ")
 								builder.WriteString(include)
 								builder.WriteString("\n")
@@ -1300,6 +3314,50 @@ func (c *Compiler) compile() {
 		}
 		builder.WriteString("#include \"gx.hh\"\n")
 		includes = builder.String()
+		for _, include := range quotedIncludes {
+			for _, dir := range c.includeDirs {
+				path := filepath.Join(dir, include)
+				if info, err := os.Stat(path); err == nil && !info.IsDir() {
+					c.inputFiles = append(c.inputFiles, path)
+					break
+				}
+			}
+		}
+	}
+
+	// Reuse cached code of unchanged packages, and save code of the others if there are no errors
+	if c.cacheDir != "" {
+		c.cacheHits = make(map[*packages.Package]*cacheEntry)
+		misses := c.loadCache(pkgs, typeSpecs, funcDecls)
+		if c.log != nil {
+			fmt.Fprintf(c.log, "gx: reused cached code of %d of %d packages\n", len(c.cacheHits), len(pkgs))
+		}
+		defer func() {
+			if !c.errored() {
+				c.saveCache(misses, typeSpecs, funcDecls)
+			}
+		}()
+	}
+
+	// Function declarations, then bodies
+	for _, funcDecl := range funcDecls {
+		c.genFuncDecl(funcDecl)
+	}
+	{
+		bodiesStart := time.Now()
+		c.genBodies(funcDecls)
+		c.logTime("generating function bodies", bodiesStart)
+	}
+
+	// C header
+	if len(c.genExportsC) > 0 {
+		c.outputH = c.genHeaderC(funcDecls)
+	}
+
+	// Output separate units
+	if c.separate {
+		c.writeUnits(pkgs, defines, pkgIncludes, typeSpecs, valueSpecs, funcDecls, behaviors, tests)
+		return
 	}
 
 	// Output '.cc'
@@ -1319,6 +3377,7 @@ func (c *Compiler) compile() {
 		for _, typeSpec := range typeSpecs {
 			if typeDefn := c.genTypeDefn(typeSpec); typeDefn != "" {
 				c.write("\n")
+				c.mapLine(typeSpec.Pos())
 				if behaviors[c.types.Defs[typeSpec.Name]] {
 					c.write("ComponentTypeListAdd(")
 					c.write(typeSpec.Name.String())
@@ -1346,6 +3405,7 @@ func (c *Compiler) compile() {
 		c.write("\n\n")
 		c.write("//\n// Function declarations\n//\n\n")
 		for _, funcDecl := range funcDecls {
+			c.mapLine(funcDecl.Pos())
 			c.write(c.genFuncDecl(funcDecl))
 			c.write(";\n")
 		}
@@ -1355,6 +3415,7 @@ func (c *Compiler) compile() {
 		c.write("//\n// Variables\n//\n\n")
 		for _, valueSpec := range valueSpecs {
 			for i, name := range valueSpec.Names {
+				c.mapLine(name.Pos())
 				if name.Obj.Kind == ast.Con {
 					c.write("constexpr ")
 				}
@@ -1374,12 +3435,25 @@ func (c *Compiler) compile() {
 		for _, funcDecl := range funcDecls {
 			if funcDecl.Body != nil {
 				c.write("\n")
+				c.mapLine(funcDecl.Pos())
 				c.write(c.genFuncDecl(funcDecl))
 				c.write(" ")
-				c.writeBlockStmt(funcDecl.Body)
+				c.writeGenFuncBody(funcDecl)
 				c.write("\n")
 			}
 		}
+
+		// C exports
+		if len(c.genExportsC) > 0 {
+			c.write("\n\n")
+			c.write("//\n// C exports\n//\n")
+			c.writeExportsC(funcDecls)
+		}
+
+		// Test runner
+		if c.test {
+			c.writeTestRunner(tests)
+		}
 	}
 
 	// Output '.hh'
@@ -1453,62 +3527,286 @@ func (c *Compiler) compile() {
 						c.outputHH.WriteString(";\n")
 					}
 				}
+			} else if exportedDecls[funcDecl] {
+				c.outputHH.WriteString(c.genFuncDecl(funcDecl))
+				c.outputHH.WriteString(";\n")
+			}
+		}
+
+		// Variables, declared `extern` since the '.cc' defines them. Constants are repeated.
+		c.outputHH.WriteString("\n\n")
+		c.outputHH.WriteString("//\n// Variables\n//\n\n")
+		for _, valueSpec := range valueSpecs {
+			if exportedDecls[valueSpec] {
+				for i, name := range valueSpec.Names {
+					typeExpr := c.genTypeExpr(c.types.TypeOf(name), valueSpec.Pos())
+					if name.Obj.Kind == ast.Con {
+						c.outputHH.WriteString("constexpr ")
+						c.outputHH.WriteString(typeExpr)
+						c.outputHH.WriteString(name.Name)
+						if i < len(valueSpec.Values) {
+							c.outputHH.WriteString(" = ")
+							c.outputHH.WriteString(c.genExpr(valueSpec.Values[i]))
+						}
+					} else {
+						c.outputHH.WriteString("extern ")
+						c.outputHH.WriteString(typeExpr)
+						c.outputHH.WriteString(name.Name)
+					}
+					c.outputHH.WriteString(";\n")
+				}
 			}
 		}
 	}
 }
 
 //
-// Main
+// API
 //
 
+// RuntimeHeader is the contents of 'gx.hh', which generated code includes from the output directory
+//
 //go:embed gx.hh
-var gxHH string
+var RuntimeHeader string
+
+// Config configures a compilation
+type Config struct {
+	MainPkgPath      string              // Path of the main package, relative to the working directory
+	PackagesConfig   *packages.Config    // Used to load packages if not nil, such as with overlays of unsaved files. Mode is ignored.
+	Packages         []*packages.Package // Already loaded main package to compile instead of loading it, such as when only some packages changed
+	Recover          bool                // Support recover using C++ exceptions
+	NoChecks         bool                // Disable runtime bounds and nil checks
+	LineDirectives   bool                // Emit #line directives pointing at Go source
+	Separate         bool                // Generate a separate unit per package
+	Test             bool                // Include '_test.gx.go' files of the main package and generate a runner of its tests instead of main
+	CheckDeterminism bool                // Compile twice and report a diagnostic if the outputs differ
+	KeepAll          bool                // Keep functions, types and variables unreachable from main, tests, exported types and '//gx:export' functions
+	Jobs             int                 // Number of function bodies generated concurrently, GOMAXPROCS if zero
+	CacheDir         string              // Caches generated code of packages, reused while their sources, imports and the compiler are unchanged. Disabled if empty.
+	OutputName       string              // Base name of output files, used to include headers of separate units
+	Log              io.Writer           // Timings of each phase are logged here if not nil
+}
 
-func main() {
-	// Arguments
-	if len(os.Args) != 3 {
-		fmt.Println("usage: gx <main_package_path> <output_prefix>")
-		return
+// Result is the output of a compilation. Outputs are only generated if there are no diagnostics.
+type Result struct {
+	CC          *File               // Main '.gx.cc'
+	HH          *File               // Main '.gx.hh', declaring types and functions of components and exports
+	H           *File               // C header declaring '//gx:export_c' functions, nil if there are none
+	Units       []*Unit             // Per-package units if separate. CC and HH are the main unit's.
+	Diagnostics []Diagnostic        // Errors found
+	Packages    []*packages.Package // Loaded main package
+	IncludeDirs []string            // Directories containing files with '//gx:include', needed by the C++ compiler
+	InputFiles  []string            // Go files and included headers that were read
+	Removed     []string            // Unreachable declarations removed from output, as 'file:line:column: kind name'
+	fileSet     *token.FileSet
+}
+
+// File is generated C++ source
+type File struct {
+	Name     string // Relative to the output directory
+	Contents string
+	lineMap  []lineMapping
+}
+
+// Unit is the output for one package when generating a separate unit per package
+type Unit struct {
+	PkgPath string
+	CC, HH  *File
+	Imports []*Unit // Units whose headers HH includes
+}
+
+// Errored reports whether there were any diagnostics
+func (r *Result) Errored() bool {
+	return len(r.Diagnostics) != 0
+}
+
+// GoPosition returns the position of the Go code that generated a line of a file
+func (r *Result) GoPosition(file *File, line int) (token.Position, bool) {
+	i := sort.Search(len(file.lineMap), func(i int) bool {
+		return file.lineMap[i].ccLine > line
+	})
+	if i == 0 {
+		return token.Position{}, false
+	}
+	return r.fileSet.PositionFor(file.lineMap[i-1].pos, true), true
+}
+
+const loadMode = packages.NeedName | packages.NeedImports | packages.NeedDeps |
+	packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo
+
+func load(packagesConfig *packages.Config, patterns ...string) ([]*packages.Package, error) {
+	loadConfig := &packages.Config{}
+	if packagesConfig != nil {
+		*loadConfig = *packagesConfig
+	}
+	loadConfig.Mode = loadMode
+	return packages.Load(loadConfig, patterns...)
+}
+
+// Compile compiles a main package and the packages it imports. It returns an error if the
+// packages couldn't be loaded, while errors in Go code are reported as diagnostics.
+func Compile(config Config) (*Result, error) {
+	c := &compiler{
+		mainPkgPath:    config.MainPkgPath,
+		packagesConfig: config.PackagesConfig,
+		pkgs:           config.Packages,
+		recover:        config.Recover,
+		noChecks:       config.NoChecks,
+		log:            config.Log,
+		lineDirectives: config.LineDirectives,
+		separate:       config.Separate,
+		test:           config.Test,
+		outputName:     config.OutputName,
+		cacheDir:       config.CacheDir,
+		jobs:           config.Jobs,
+		keepAll:        config.KeepAll,
+	}
+	if c.jobs == 0 {
+		c.jobs = runtime.GOMAXPROCS(0)
+	}
+	if c.outputName == "" {
+		c.outputName = "main"
+	}
+
+	// Load main package, unless already loaded
+	if c.pkgs == nil {
+		loadStart := time.Now()
+		pkgs, err := load(c.packagesConfig, c.mainPkgPath)
+		if err != nil {
+			return nil, err
+		}
+		c.pkgs = pkgs
+		c.logTime("loading packages", loadStart)
 	}
-	mainPkgPath := os.Args[1]
-	outputPrefix := os.Args[2]
 
 	// Compile
-	c := Compiler{mainPkgPath: mainPkgPath}
 	c.compile()
-
-	// Print output
+	result := &Result{
+		Diagnostics: c.diagnostics,
+		Packages:    c.pkgs,
+		IncludeDirs: c.includeDirs,
+		InputFiles:  c.inputFiles,
+		Removed:     c.removed,
+		fileSet:     c.fileSet,
+	}
 	if c.errored() {
-		fmt.Println(c.errors)
-		os.Exit(1)
-	} else {
-		readersEqual := func(a, b io.Reader) bool {
-			bufA := make([]byte, 1024)
-			bufB := make([]byte, 1024)
-			for {
-				nA, errA := io.ReadFull(a, bufA)
-				nB, _ := io.ReadFull(b, bufB)
-				if !bytes.Equal(bufA[:nA], bufB[:nB]) {
-					return false
-				}
-				if errA == io.EOF {
-					return true
-				}
+		return result, nil
+	}
+	if c.outputH != "" {
+		result.H = &File{Name: c.outputName + ".gx.h", Contents: c.outputH}
+	}
+	if c.separate {
+		units := make(map[*unit]*Unit)
+		for _, u := range c.units {
+			resultUnit := &Unit{
+				PkgPath: u.pkg.PkgPath,
+				CC:      &File{Name: c.unitFileName(u, ".gx.cc"), Contents: u.outputCC, lineMap: u.lineMapCC},
+				HH:      &File{Name: c.unitFileName(u, ".gx.hh"), Contents: u.outputHH, lineMap: u.lineMapHH},
+			}
+			units[u] = resultUnit
+			result.Units = append(result.Units, resultUnit)
+			if u.name == "" {
+				result.CC, result.HH = resultUnit.CC, resultUnit.HH
 			}
 		}
-		writeFileIfChanged := func(path string, contents string) {
-			byteContents := []byte(contents)
-			if f, err := os.Open(path); err == nil {
-				defer f.Close()
-				if readersEqual(f, bytes.NewReader(byteContents)) {
-					return
-				}
+		for _, u := range c.units {
+			for _, imp := range u.imports {
+				units[u].Imports = append(units[u].Imports, units[imp])
+			}
+		}
+	} else {
+		result.CC = &File{Name: c.outputName + ".gx.cc", Contents: c.outputCC.String(), lineMap: c.lineMap}
+		result.HH = &File{Name: c.outputName + ".gx.hh", Contents: c.outputHH.String()}
+	}
+
+	// Compile again and compare, if checking determinism. Packages are loaded again unless given,
+	// and code is generated anew rather than read back from the cache.
+	if config.CheckDeterminism {
+		again := config
+		again.CheckDeterminism = false
+		again.CacheDir = ""
+		again.Log = nil
+		againResult, err := Compile(again)
+		if err != nil {
+			return nil, err
+		}
+		if diagnostic, ok := compareOutputs(result, againResult); !ok {
+			result.Diagnostics = append(result.Diagnostics, diagnostic)
+		}
+	}
+	return result, nil
+}
+
+// files returns the generated files of a result in output order
+func (r *Result) files() []*File {
+	if len(r.Units) > 0 {
+		var files []*File
+		for _, unit := range r.Units {
+			files = append(files, unit.CC, unit.HH)
+		}
+		if r.H != nil {
+			files = append(files, r.H)
+		}
+		return files
+	}
+	if r.H != nil {
+		return []*File{r.CC, r.HH, r.H}
+	}
+	return []*File{r.CC, r.HH}
+}
+
+// compareOutputs reports the first line that differs between the outputs of two compilations
+func compareOutputs(a, b *Result) (Diagnostic, bool) {
+	diagnostic := Diagnostic{Severity: "error", Code: gxcheck.CodeInternal}
+	aFiles, bFiles := a.files(), b.files()
+	if b.Errored() || len(aFiles) != len(bFiles) {
+		diagnostic.Message = "internal error: output is not deterministic: compiling again generated different files"
+		return diagnostic, false
+	}
+	for i, aFile := range aFiles {
+		bFile := bFiles[i]
+		if aFile.Name == bFile.Name && aFile.Contents == bFile.Contents {
+			continue
+		}
+		aLines, bLines := strings.Split(aFile.Contents, "\n"), strings.Split(bFile.Contents, "\n")
+		line := 0
+		for line < len(aLines) && line < len(bLines) && aLines[line] == bLines[line] {
+			line++
+		}
+		diagnostic.File = aFile.Name
+		diagnostic.Line, diagnostic.Column = line+1, 1
+		diagnostic.EndLine, diagnostic.EndColumn = line+1, 1
+		diagnostic.Message = "internal error: output is not deterministic: line differs when compiling again"
+		return diagnostic, false
+	}
+	return diagnostic, true
+}
+
+// Vet reports code gx can't compile in '.gx.go' files of packages matching the patterns, without
+// generating code. packagesConfig is used to load packages if not nil.
+func Vet(packagesConfig *packages.Config, patterns ...string) ([]Diagnostic, error) {
+	pkgs, err := load(packagesConfig, patterns...)
+	if err != nil {
+		return nil, err
+	}
+	c := &compiler{}
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		for _, err := range pkg.Errors {
+			c.goErrorf(err.Pos, "%s", err.Msg)
+		}
+	})
+	if c.errored() {
+		return c.diagnostics, nil
+	}
+	for _, pkg := range pkgs {
+		c.fileSet = pkg.Fset
+		var files []*ast.File
+		for _, file := range pkg.Syntax {
+			if strings.HasSuffix(c.fileSet.Position(file.Pos()).Filename, ".gx.go") {
+				files = append(files, file)
 			}
-			ioutil.WriteFile(path, byteContents, 0644)
 		}
-		writeFileIfChanged(filepath.Dir(outputPrefix)+"/gx.hh", gxHH)
-		writeFileIfChanged(outputPrefix+".gx.cc", c.outputCC.String())
-		writeFileIfChanged(outputPrefix+".gx.hh", c.outputHH.String())
+		gxcheck.Check(pkg.TypesInfo, files, c.errorf)
 	}
+	return c.diagnostics, nil
 }
@@ -1,11 +1,41 @@
 #pragma once
 
+#include <cstddef>
 #include <cstdio>
 #include <cstdlib>
 #include <cstring>
+#include <exception>
 #include <new>
+#include <type_traits>
 #include <utility>
 
+#if defined(GX_RECOVER) && !defined(__cpp_exceptions)
+#error "gx: `recover` support requires C++ exceptions to be enabled"
+#endif
+
+// Attributes of the `extern "C"` wrappers of `//gx:export_c` functions. Define before including to
+// override, such as to nothing to leave out `EMSCRIPTEN_KEEPALIVE`.
+#ifndef GX_EXPORT_C
+#if defined(__EMSCRIPTEN__)
+#include <emscripten.h>
+#define GX_EXPORT_C EMSCRIPTEN_KEEPALIVE
+#elif defined(_WIN32)
+#define GX_EXPORT_C __declspec(dllexport)
+#else
+#define GX_EXPORT_C __attribute__((visibility("default")))
+#endif
+#endif
+
+// Calls C++ member function `name` on a receiver or a pointer to one. Methods bound with
+// `//gx:extern GX_METHOD(name)` are called as `GX_METHOD(name)(recv, args...)`.
+#define GX_METHOD(name)                                                                          \
+  [](auto &&self, auto &&...args) -> decltype(auto) {                                            \
+    if constexpr (std::is_pointer_v<std::remove_cvref_t<decltype(self)>>) {                      \
+      return self->name(std::forward<decltype(args)>(args)...);                                  \
+    } else {                                                                                     \
+      return self.name(std::forward<decltype(args)>(args)...);                                   \
+    }                                                                                            \
+  }
 
 namespace gx {
 
@@ -47,31 +77,241 @@ void println(Args &&...args) {
   print("\n");
 }
 
-template<typename... Args>
-void fatal(Args &&...args) {
-  println(std::forward<Args>(args)...);
+
+//
+// Panic
+//
+
+using PanicHandler = void (*)(const char *msg, const char *pos);
+
+inline PanicHandler panicHandler = nullptr;
+
+inline void setPanicHandler(PanicHandler handler) {
+  panicHandler = handler;
+}
+
+[[noreturn]] inline void crash(const char *msg, const char *pos) {
   std::fflush(stdout);
+  if (panicHandler) {
+    panicHandler(msg, pos);
+  }
+  if (pos) {
+    std::fprintf(stderr, "panic: %s\n\t%s\n", msg, pos);
+  } else {
+    std::fprintf(stderr, "panic: %s\n", msg);
+  }
+  std::fflush(stderr);
   std::abort();
 }
 
+#ifdef GX_RECOVER
+struct Panic {
+  const char *msg;
+  const char *pos;
+};
+
+// The current panic. A panic thrown while another is unwinding replaces it, so catchers should
+// report these rather than the members of the `Panic` they caught.
+inline thread_local char *panicMsg = nullptr;
+inline thread_local const char *panicPos = nullptr;
+inline thread_local bool panicking = false;
+
+inline const char *recover() {
+  if (!panicking || std::uncaught_exceptions() == 0) {
+    return nullptr;
+  }
+  panicking = false;
+  return panicMsg;
+}
+
+// Called in a `catch (...)`, returns whether the exception is a panic, which is then recovered and
+// reported through `msg` and `pos`. Lets code included before this header, like the test runner,
+// handle panics.
+inline bool caughtPanic(const char **msg, const char **pos) {
+  try {
+    throw;
+  } catch (Panic &) {
+    panicking = false;
+    *msg = panicMsg;
+    *pos = panicPos;
+    return true;
+  } catch (...) {
+    return false;
+  }
+}
+#endif
+
+template<typename... Args>
+[[noreturn]] void fatal(const char *pos, const char *format, Args... args) {
+  // Sized to fit, and allocated since the message outlives this frame when recovering
+  char *msg;
+  if constexpr (sizeof...(Args) == 0) {
+    int size = int(std::strlen(format)) + 1;
+    msg = (char *)std::malloc(size);
+    std::memcpy(msg, format, size);
+  } else {
+    int size = std::snprintf(nullptr, 0, format, args...) + 1;
+    msg = (char *)std::malloc(size);
+    std::snprintf(msg, size, format, args...);
+  }
+#ifdef GX_RECOVER
+  std::free(panicMsg); // Freed after formatting, since arguments may point into it
+  panicMsg = msg;
+  panicPos = pos;
+  panicking = true;
+  throw Panic { panicMsg, pos };
+#else
+  crash(msg, pos);
+#endif
+}
+
+
+//
+// Defer
+//
+
+template<typename F>
+struct Defer {
+  F func;
+#ifdef GX_RECOVER
+  int exceptions = std::uncaught_exceptions();
+#endif
+
+  Defer(F func_)
+      : func(std::move(func_)) {
+  }
+
+  Defer(const Defer &) = delete;
+  Defer &operator=(const Defer &) = delete;
+
+  ~Defer() noexcept(false) {
+#ifdef GX_RECOVER
+    if (std::uncaught_exceptions() > exceptions) {
+      // Throwing while a panic unwinds would terminate. The new panic already replaced the current
+      // one in `panicMsg` and `panicPos`, so the unwinding one carries on in its place.
+      try {
+        func();
+      } catch (Panic &) {
+      }
+      return;
+    }
+#endif
+    func();
+  }
+};
+
+
+//
+// Slice storage
+//
+
+// With `GX_DEBUG_POINTERS` defined, slice buffers that are reallocated or freed are kept in a
+// quarantine instead of being released right away, so that dereferencing a pointer into them can
+// be detected by `deref`. The quarantine holds up to `GX_DEBUG_POINTERS_QUARANTINE_BYTES` of
+// buffers, releasing the oldest ones past that. `deref` scans it linearly, so a smaller budget
+// trades detection for speed. String storage is never quarantined since it can't be pointed into,
+// which keeps string temporaries from pushing slice buffers out.
+
+#ifdef GX_DEBUG_POINTERS
+#ifndef GX_DEBUG_POINTERS_QUARANTINE_BYTES
+#define GX_DEBUG_POINTERS_QUARANTINE_BYTES (4 << 20)
+#endif
+
+struct StaleBuffer {
+  const char *begin = nullptr;
+  const char *end = nullptr;
+};
+
+inline StaleBuffer *staleBuffers = nullptr; // Ring buffer, oldest first
+inline int staleBuffersFirst = 0;
+inline int staleBuffersCount = 0;
+inline int staleBuffersCapacity = 0;
+inline size_t staleBytes = 0;
+
+inline void quarantineBuffer(void *data, size_t size) {
+  if (staleBuffersCount == staleBuffersCapacity) {
+    auto capacity = staleBuffersCapacity == 0 ? 64 : staleBuffersCapacity << 1;
+    auto buffers = (StaleBuffer *)std::malloc(sizeof(StaleBuffer) * capacity);
+    for (auto i = 0; i < staleBuffersCount; ++i) {
+      buffers[i] = staleBuffers[(staleBuffersFirst + i) % staleBuffersCapacity];
+    }
+    std::free(staleBuffers);
+    staleBuffers = buffers;
+    staleBuffersFirst = 0;
+    staleBuffersCapacity = capacity;
+  }
+  auto &stale = staleBuffers[(staleBuffersFirst + staleBuffersCount) % staleBuffersCapacity];
+  stale.begin = (const char *)data;
+  stale.end = (const char *)data + size;
+  ++staleBuffersCount;
+  staleBytes += size;
+  while (staleBytes > GX_DEBUG_POINTERS_QUARANTINE_BYTES && staleBuffersCount > 1) {
+    auto &oldest = staleBuffers[staleBuffersFirst];
+    staleBytes -= oldest.end - oldest.begin;
+    std::free((void *)oldest.begin);
+    staleBuffersFirst = (staleBuffersFirst + 1) % staleBuffersCapacity;
+    --staleBuffersCount;
+  }
+}
+
+inline bool isStalePointer(const void *ptr) {
+  for (auto i = 0; i < staleBuffersCount; ++i) {
+    auto &stale = staleBuffers[(staleBuffersFirst + i) % staleBuffersCapacity];
+    if (stale.begin <= (const char *)ptr && (const char *)ptr < stale.end) {
+      return true;
+    }
+  }
+  return false;
+}
+#endif
+
+inline void *reallocBuffer(void *data, size_t oldSize, size_t newSize, bool quarantine = true) {
+#ifdef GX_DEBUG_POINTERS
+  if (quarantine) {
+    auto newData = std::malloc(newSize);
+    if (data) {
+      std::memcpy(newData, data, oldSize < newSize ? oldSize : newSize);
+      quarantineBuffer(data, oldSize);
+    }
+    return newData;
+  }
+#endif
+  return std::realloc(data, newSize);
+}
+
+inline void freeBuffer(void *data, size_t size, bool quarantine = true) {
+#ifdef GX_DEBUG_POINTERS
+  if (data && quarantine) {
+    quarantineBuffer(data, size);
+    return;
+  }
+#endif
+  std::free(data);
+}
+
 
 //
 // Pointer
 //
 
 template<typename T>
-T &deref(T *ptr) {
+T &deref(T *ptr, const char *pos = nullptr) {
 #ifndef GX_NO_CHECKS
   if (!ptr) {
-    fatal("gx: nil pointer dereference");
+    fatal(pos, "runtime error: invalid memory address or nil pointer dereference");
+  }
+#endif
+#ifdef GX_DEBUG_POINTERS
+  if (isStalePointer(ptr)) {
+    fatal(pos, "runtime error: dangling pointer into slice storage that was reallocated or freed");
   }
 #endif
   return *ptr;
 }
 
 template<typename T>
-const T &deref(const T *ptr) {
-  return deref(const_cast<T *>(ptr));
+const T &deref(const T *ptr, const char *pos = nullptr) {
+  return deref(const_cast<T *>(ptr), pos);
 }
 
 
@@ -83,17 +323,25 @@ template<typename T, int N>
 struct Array {
   T data[N] {};
 
-  T &operator[](int i) {
+  T &at(int i, const char *pos = nullptr) {
 #ifndef GX_NO_CHECKS
     if (!(0 <= i && i < N)) {
-      fatal("gx: array index out of bounds");
+      fatal(pos, "runtime error: index out of range [%d] with length %d", i, N);
     }
 #endif
     return data[i];
   }
 
+  const T &at(int i, const char *pos = nullptr) const {
+    return const_cast<Array &>(*this).at(i, pos);
+  }
+
+  T &operator[](int i) {
+    return at(i);
+  }
+
   const T &operator[](int i) const {
-    return const_cast<Array &>(*this)[i];
+    return at(i);
   }
 
   T *begin() {
@@ -189,20 +437,28 @@ struct Slice {
     for (auto &elem : *this) {
       elem.~T();
     }
-    std::free(data);
+    freeBuffer(data, sizeof(T) * capacity, !std::is_same_v<T, char>);
   }
 
-  T &operator[](int i) {
+  T &at(int i, const char *pos = nullptr) {
 #ifndef GX_NO_CHECKS
     if (!(0 <= i && i < size)) {
-      fatal("gx: slice index out of bounds");
+      fatal(pos, "runtime error: index out of range [%d] with length %d", i, size);
     }
 #endif
     return data[i];
   }
 
+  const T &at(int i, const char *pos = nullptr) const {
+    return const_cast<Slice &>(*this).at(i, pos);
+  }
+
+  T &operator[](int i) {
+    return at(i);
+  }
+
   const T &operator[](int i) const {
-    return const_cast<Slice &>(*this)[i];
+    return at(i);
   }
 
   T *begin() {
@@ -231,14 +487,16 @@ template<typename T>
 void insert(Slice<T> &s, int i, T val) {
 #ifndef GX_NO_CHECKS
   if (!(0 <= i && i <= s.size)) {
-    fatal("gx: slice index out of bounds");
+    fatal(nullptr, "runtime error: index out of range [%d] with length %d", i, s.size);
   }
 #endif
   auto moveCount = s.size - i;
   ++s.size;
   if (s.size > s.capacity) {
+    auto oldCapacity = s.capacity;
     s.capacity = s.capacity == 0 ? 2 : s.capacity << 1;
-    s.data = (T *)std::realloc(s.data, sizeof(T) * s.capacity);
+    s.data = (T *)reallocBuffer(
+        s.data, sizeof(T) * oldCapacity, sizeof(T) * s.capacity, !std::is_same_v<T, char>);
   }
   std::memmove(&s.data[i + 1], &s.data[i], sizeof(T) * moveCount);
   new (&s.data[i]) T(std::move(val));
@@ -260,7 +518,7 @@ template<typename T>
 void remove(Slice<T> &s, int i) {
 #ifndef GX_NO_CHECKS
   if (!(0 <= i && i < s.size)) {
-    fatal("gx: slice index out of bounds");
+    fatal(nullptr, "runtime error: index out of range [%d] with length %d", i, s.size);
   }
 #endif
   auto moveCount = s.size - (i + 1);
@@ -285,26 +543,51 @@ struct String {
     slice.copyFrom(s, std::strlen(s) + 1);
   }
 
+  String(const char *s, int n) {
+    slice.copyFrom(s, n);
+    append(slice, '\0');
+  }
+
   operator const char *() const {
     return (const char *)slice.data;
   }
 
-  char &operator[](int i) {
+  char &at(int i, const char *pos = nullptr) {
 #ifndef GX_NO_CHECKS
-    if (!(0 <= i && i < slice.size)) {
-      fatal("gx: string index out of bounds");
+    if (!(0 <= i && i < slice.size - 1)) {
+      fatal(pos, "runtime error: index out of range [%d] with length %d", i, slice.size - 1);
     }
 #endif
-    return slice[i];
+    return slice.data[i];
+  }
+
+  const char &at(int i, const char *pos = nullptr) const {
+    return const_cast<String &>(*this).at(i, pos);
+  }
+
+  char &operator[](int i) {
+    return at(i);
+  }
+
+  const char &operator[](int i) const {
+    return at(i);
   }
 
   auto begin() {
     return slice.begin();
   }
 
+  auto begin() const {
+    return slice.begin();
+  }
+
   auto end() {
     return slice.end() - 1;
   }
+
+  auto end() const {
+    return slice.end() - 1;
+  }
 };
 
 inline int len(const String &s) {
@@ -0,0 +1,336 @@
+package gx
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "regenerate golden files in 'testdata/golden'")
+
+// TestGolden compiles each package in 'testdata/golden' and compares the generated '.cc',
+// '.hh' and C header with the package's '.golden' files. Run with -update to regenerate them after
+// intended changes to the output. A package can enable -recover with a 'gx.json' like a project's.
+func TestGolden(t *testing.T) {
+	entries, err := os.ReadDir(filepath.Join("testdata", "golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join("testdata", "golden", entry.Name())
+		t.Run(entry.Name(), func(t *testing.T) {
+			pkgs, err := load(nil, "./"+filepath.ToSlash(dir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var config struct {
+				Recover bool `json:"recover"`
+			}
+			if data, err := os.ReadFile(filepath.Join(dir, "gx.json")); err == nil {
+				if err := json.Unmarshal(data, &config); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c := &compiler{pkgs: pkgs, outputName: "main", recover: config.Recover}
+			c.compile()
+			for _, diagnostic := range c.diagnostics {
+				t.Error(diagnostic)
+			}
+			if c.errored() {
+				return
+			}
+			type output struct{ name, contents string }
+			outputs := []output{
+				{"main.gx.cc.golden", c.outputCC.String()},
+				{"main.gx.hh.golden", c.outputHH.String()},
+			}
+			if c.outputH != "" {
+				outputs = append(outputs, output{"main.gx.h.golden", c.outputH})
+			}
+			for _, output := range outputs {
+				path := filepath.Join(dir, output.name)
+				if *update {
+					if err := os.WriteFile(path, []byte(output.contents), 0644); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				golden, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatalf("%v (run with -update to create it)", err)
+				}
+				if string(golden) != output.contents {
+					t.Errorf("%s differs from generated code (run with -update if the change is intended):\n%s",
+						path, firstDifference(string(golden), output.contents))
+				}
+			}
+		})
+	}
+}
+
+// firstDifference describes the first line that differs between golden and generated code
+func firstDifference(golden, generated string) string {
+	line := 1
+	start := 0
+	for i := 0; i < len(golden) && i < len(generated); i++ {
+		if golden[i] != generated[i] {
+			return fmt.Sprintf("line %d:\n  golden:    %s\n  generated: %s", line, lineAt(golden, start), lineAt(generated, start))
+		}
+		if golden[i] == '\n' {
+			line++
+			start = i + 1
+		}
+	}
+	return fmt.Sprintf("line %d: one is a prefix of the other", line)
+}
+
+func lineAt(s string, start int) string {
+	for i := start; i < len(s); i++ {
+		if s[i] == '\n' {
+			return s[start:i]
+		}
+	}
+	return s[start:]
+}
+
+// TestDeterminism compiles the example twice in each output mode and checks that the outputs
+// are identical
+func TestDeterminism(t *testing.T) {
+	for _, separate := range []bool{false, true} {
+		result, err := Compile(Config{MainPkgPath: "./example", Separate: separate, CheckDeterminism: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, diagnostic := range result.Diagnostics {
+			t.Errorf("separate=%v: %v", separate, diagnostic)
+		}
+	}
+
+	// With a cache, compiling again must not read back what the first compile cached. Tamper with
+	// cached bodies so that only code generated anew differs from them.
+	config := Config{MainPkgPath: "./example", CacheDir: t.TempDir()}
+	if _, err := Compile(config); err != nil {
+		t.Fatal(err)
+	}
+	paths, _ := filepath.Glob(filepath.Join(config.CacheDir, "*.json"))
+	if len(paths) == 0 {
+		t.Fatal("no cache entries written")
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry := &cacheEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			t.Fatal(err)
+		}
+		for key, body := range entry.FuncBodies {
+			body.Code = "/* stale */ " + body.Code
+			entry.FuncBodies[key] = body
+		}
+		if data, err = json.Marshal(entry); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config.CheckDeterminism = true
+	result, err := Compile(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Errored() {
+		t.Error("cached output wasn't compared against code generated anew")
+	}
+}
+
+// TestUnsupportedTypeDiagnostics compiles function bodies that share an unsupported type across
+// many workers, and checks that each use is reported the same way as when compiling serially
+func TestUnsupportedTypeDiagnostics(t *testing.T) {
+	src := &strings.Builder{}
+	src.WriteString("package main\n")
+	for i := 0; i < 16; i++ {
+		fmt.Fprintf(src, "\nfunc f%d() {\n\tx := int64(%d)\n\tx++\n}\n", i, i)
+	}
+	src.WriteString("\nfunc main() {\n\tf0()\n}\n")
+	compile := func(jobs int) []Diagnostic {
+		c := &compiler{pkgs: parseProgram(src.String()), outputName: "main", keepAll: true, jobs: jobs}
+		c.compile()
+		return c.diagnostics
+	}
+	expected := compile(1)
+	if len(expected) < 16 {
+		t.Fatalf("expected a diagnostic in each function, got %v", expected)
+	}
+	for i := 0; i < 20; i++ {
+		if diagnostics := compile(8); !reflect.DeepEqual(diagnostics, expected) {
+			t.Fatalf("diagnostics differ across workers:\n%v\nexpected:\n%v", diagnostics, expected)
+		}
+	}
+}
+
+// TestSeparateComponents checks that in separate mode components are registered once, by the main
+// unit's source rather than by a header that every unit includes
+func TestSeparateComponents(t *testing.T) {
+	result, err := Compile(Config{MainPkgPath: "./testdata/golden/metadata", Separate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, diagnostic := range result.Diagnostics {
+		t.Fatal(diagnostic)
+	}
+	for _, unit := range result.Units {
+		if strings.Contains(unit.HH.Contents, "ComponentTypeListAdd") {
+			t.Errorf("%s registers components", unit.HH.Name)
+		}
+	}
+	for _, name := range []string{"Position", "Health", "Sprite"} {
+		if count := strings.Count(result.CC.Contents, "ComponentTypeListAdd("+name+");"); count != 1 {
+			t.Errorf("%s registered %d times in %s", name, count, result.CC.Name)
+		}
+	}
+}
+
+// TestCache compiles the example with an empty cache and then with the filled cache, and checks
+// that reusing cached code generates the same output
+func TestCache(t *testing.T) {
+	for _, separate := range []bool{false, true} {
+		config := Config{MainPkgPath: "./example", Separate: separate, LineDirectives: true, CacheDir: t.TempDir()}
+		var results []*Result
+		for i := 0; i < 2; i++ {
+			result, err := Compile(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, diagnostic := range result.Diagnostics {
+				t.Fatal(diagnostic)
+			}
+			results = append(results, result)
+		}
+		if entries, _ := os.ReadDir(config.CacheDir); len(entries) == 0 {
+			t.Fatalf("separate=%v: no cache entries written", separate)
+		}
+		if diagnostic, ok := compareOutputs(results[0], results[1]); !ok {
+			t.Errorf("separate=%v: %v", separate, diagnostic)
+		}
+		for i, file := range results[0].files() {
+			if !reflect.DeepEqual(lineMapPositions(results[0], file), lineMapPositions(results[1], results[1].files()[i])) {
+				t.Errorf("separate=%v: line map of %s differs when reusing cached code", separate, file.Name)
+			}
+		}
+	}
+}
+
+// lineMapPositions resolves the Go positions a file's lines map to, which can be compared across
+// loads unlike token.Pos
+func lineMapPositions(result *Result, file *File) []string {
+	var positions []string
+	for _, mapping := range file.lineMap {
+		positions = append(positions, fmt.Sprintf("%d %v", mapping.ccLine, result.fileSet.Position(mapping.pos)))
+	}
+	return positions
+}
+
+// TestDebugPointers runs a program that writes through a pointer into a reallocated slice buffer
+// after churning string temporaries and smaller slices, and checks that `GX_DEBUG_POINTERS` still
+// detects the stale write. Skipped without a C++ compiler, like the other C++ checks.
+func TestDebugPointers(t *testing.T) {
+	cxx := fuzzCXX()
+	if cxx == "" {
+		t.Skip("no C++ compiler")
+	}
+	src := `package main
+
+func length(str string) int {
+	return len(str)
+}
+
+func main() {
+	s := []int{}
+	for i := 0; i < 100; i++ {
+		s = append(s, i)
+	}
+	p := &s[0]
+	for i := 0; i < 100; i++ {
+		s = append(s, i)
+	}
+	total := 0
+	for i := 0; i < 1000; i++ {
+		total += length("temporary")
+		t := []int{i}
+		total += len(t)
+	}
+	*p = 5
+	println(total, len(s))
+}
+`
+	c := &compiler{pkgs: parseProgram(src), outputName: "main"}
+	c.compile()
+	if c.errored() {
+		t.Fatalf("program failed to compile: %v", c.diagnostics)
+	}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "gx.hh"), []byte(RuntimeHeader), 0644)
+	ccPath := filepath.Join(dir, "main.gx.cc")
+	os.WriteFile(ccPath, []byte(c.outputCC.String()), 0644)
+	binPath := filepath.Join(dir, "main")
+	if output, err := exec.Command(cxx, "-std=c++20", "-DGX_DEBUG_POINTERS", "-o", binPath, ccPath).CombinedOutput(); err != nil {
+		t.Fatalf("C++ compiler rejected generated code: %v\n%s", err, output)
+	}
+	output, err := exec.Command(binPath).CombinedOutput()
+	if err == nil || !strings.Contains(string(output), "dangling pointer") {
+		t.Errorf("stale write not detected: %v\n%s", err, output)
+	}
+}
+
+// TestRecoverTests runs tests built with -recover, where a panicking test must fail without
+// stopping the tests after it. Skipped without a C++ compiler.
+func TestRecoverTests(t *testing.T) {
+	cxx := fuzzCXX()
+	if cxx == "" {
+		t.Skip("no C++ compiler")
+	}
+	dir := t.TempDir()
+	result, err := Compile(Config{MainPkgPath: "./testdata/testing/panics", Test: true, Recover: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, diagnostic := range result.Diagnostics {
+		t.Fatal(diagnostic)
+	}
+	os.WriteFile(filepath.Join(dir, "gx.hh"), []byte(RuntimeHeader), 0644)
+	ccPath := filepath.Join(dir, result.CC.Name)
+	os.WriteFile(ccPath, []byte(result.CC.Contents), 0644)
+	binPath := filepath.Join(dir, "panics.test")
+	args := []string{"-std=c++20", "-o", binPath, ccPath}
+	for _, includeDir := range result.IncludeDirs {
+		args = append(args, "-I"+includeDir)
+	}
+	if output, err := exec.Command(cxx, args...).CombinedOutput(); err != nil {
+		t.Fatalf("C++ compiler rejected generated code: %v\n%s", err, output)
+	}
+	output, err := exec.Command(binPath, "-v").CombinedOutput()
+	if err == nil {
+		t.Errorf("tests passed despite a panic:\n%s", output)
+	}
+	for _, want := range []string{
+		"--- FAIL: TestPanics",
+		"panic: runtime error: index out of range [2] with length 2",
+		"--- PASS: TestAfterPanic",
+	} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("output lacks %q:\n%s", want, output)
+		}
+	}
+}
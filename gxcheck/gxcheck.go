@@ -0,0 +1,649 @@
+// Package gxcheck checks that Go code is in the subset gx can compile. It's used by the compiler
+// and is available as an Analyzer so editors and 'go vet' can report the same errors.
+package gxcheck
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"regexp"
+	"strings"
+
+	"golang.org/x/tools/go/analysis"
+)
+
+//
+// Error codes
+//
+
+// Error codes are stable identifiers of kinds of errors for tools that process diagnostics. Don't
+// renumber them, only add new ones.
+const (
+	CodeGo                 = "GX0001" // Reported by the Go toolchain while loading packages
+	CodeInternal           = "GX0002"
+	CodeUnsupportedType    = "GX0003"
+	CodeNoSuchField        = "GX0004"
+	CodeArrayParam         = "GX0005"
+	CodeSliceParam         = "GX0006"
+	CodeUnsupportedLiteral = "GX0007"
+	CodeFieldOrder         = "GX0008"
+	CodePanicArg           = "GX0009"
+	CodeRecover            = "GX0010"
+	CodeAddressOfTemporary = "GX0011"
+	CodeMultipleReturn     = "GX0012"
+	CodeUnsupportedUnary   = "GX0013"
+	CodeUnsupportedBinary  = "GX0014"
+	CodeUnsupportedKey     = "GX0015"
+	CodeUnsupportedExpr    = "GX0016"
+	CodeMultiAssign        = "GX0017"
+	CodeUnsupportedAssign  = "GX0018"
+	CodeUnsupportedBranch  = "GX0019"
+	CodeDeferArgs          = "GX0020"
+	CodeRangeDefine        = "GX0021"
+	CodeUnsupportedStmt    = "GX0022"
+	CodeNestedDefer        = "GX0023"
+	CodeEscape             = "GX0024"
+	CodeTestSignature      = "GX0025"
+	CodeUnsupportedBuiltin = "GX0026"
+	CodeMethodValue        = "GX0027"
+	CodeEmbedded           = "GX0028"
+	CodeExport             = "GX0029"
+)
+
+// Fixes are suggested fixes for errors with the given codes
+var Fixes = map[string]string{
+	CodeArrayParam:     "pass a pointer to the array instead",
+	CodeSliceParam:     "pass a pointer to the slice instead",
+	CodeFieldOrder:     "reorder the fields to match the struct definition",
+	CodeRecover:        "compile with -recover",
+	CodeMultipleReturn: "return a struct instead",
+	CodeMultiAssign:    "split into one assignment per variable",
+	CodeDeferArgs:      "defer a function literal that makes the call, such as 'defer func() { f(x) }()'",
+	CodeRangeDefine:    "declare the range variables with :=",
+	CodeNestedDefer:    "move the defer to the top level of the function body",
+	CodeEscape:         "allocate the value in a slice or a global that outlives the function",
+	CodeMethodValue:    "call the method in a function literal instead, such as 'func() { v.f() }'",
+	CodeEmbedded:       "name the field and select through it",
+	CodeExport:         "export a non-generic function without function parameters that calls this one",
+	CodeTestSignature:  "declare the test as 'func TestXxx(t *testing.T)' using github.com/nikki93/gx/testing",
+}
+
+//
+// Analyzer
+//
+
+// Analyzer reports code outside the subset gx can compile in '.gx.go' files. It can be run with
+// 'go vet -vettool' using the 'gxvet' command, or added to any driver built on go/analysis, such
+// as a gopls build.
+var Analyzer = &analysis.Analyzer{
+	Name: "gx",
+	Doc:  "report code gx can't compile",
+	Run: func(pass *analysis.Pass) (interface{}, error) {
+		var files []*ast.File
+		for _, file := range pass.Files {
+			if strings.HasSuffix(pass.Fset.Position(file.Pos()).Filename, ".gx.go") {
+				files = append(files, file)
+			}
+		}
+		Check(pass.TypesInfo, files, func(code string, node ast.Node, format string, args ...interface{}) {
+			pass.Report(analysis.Diagnostic{
+				Pos:      node.Pos(),
+				End:      node.End(),
+				Category: code,
+				Message:  code + ": " + fmt.Sprintf(format, args...),
+			})
+		})
+		return nil, nil
+	},
+}
+
+//
+// Checks
+//
+
+// Reporter is called with each error found
+type Reporter func(code string, node ast.Node, format string, args ...interface{})
+
+type checker struct {
+	types  *types.Info
+	report Reporter
+}
+
+// span is a range of positions that can be reported in place of a node
+type span struct {
+	pos, end token.Pos
+}
+
+func (s span) Pos() token.Pos {
+	return s.pos
+}
+
+func (s span) End() token.Pos {
+	return s.end
+}
+
+var externsRe = regexp.MustCompile(`//gx:externs (.*)`)
+var externRe = regexp.MustCompile(`//gx:extern (.*)`)
+
+func hasDirective(re *regexp.Regexp, doc *ast.CommentGroup) bool {
+	if doc != nil {
+		for _, comment := range doc.List {
+			if re.MatchString(comment.Text) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check reports code in files that gx can't compile. Declarations that are externs aren't
+// compiled, so they aren't checked.
+func Check(info *types.Info, files []*ast.File, report Reporter) {
+	ch := &checker{types: info, report: report}
+	for _, file := range files {
+		fileExtern := len(file.Comments) > 0 && hasDirective(externsRe, file.Comments[0])
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.GenDecl:
+				declExtern := fileExtern || hasDirective(externRe, decl.Doc)
+				for _, spec := range decl.Specs {
+					if spec, ok := spec.(*ast.ValueSpec); ok && !declExtern && !hasDirective(externRe, spec.Doc) {
+						for _, value := range spec.Values {
+							ch.checkExpr(value)
+						}
+					}
+				}
+			case *ast.FuncDecl:
+				if !fileExtern && !hasDirective(externRe, decl.Doc) {
+					ch.checkFuncDecl(decl)
+				}
+			}
+		}
+	}
+}
+
+func (ch *checker) checkFuncDecl(decl *ast.FuncDecl) {
+	// Results
+	if decl.Type.Results.NumFields() > 1 {
+		ch.report(CodeMultipleReturn, decl.Type.Results, "multiple return values not supported")
+	}
+
+	// Parameters
+	var fields []*ast.Field
+	if decl.Recv != nil {
+		fields = append(fields, decl.Recv.List...)
+	}
+	fields = append(fields, decl.Type.Params.List...)
+	for _, field := range fields {
+		var nodes []ast.Node
+		for _, name := range field.Names {
+			nodes = append(nodes, name)
+		}
+		if len(nodes) == 0 {
+			nodes = append(nodes, field.Type)
+		}
+		typ := ch.types.TypeOf(field.Type)
+		if typ == nil {
+			continue
+		}
+		for _, node := range nodes {
+			switch typ.Underlying().(type) {
+			case *types.Array:
+				ch.report(CodeArrayParam, node, "cannot pass array by value, use pointer to array *%s instead", typ)
+			case *types.Slice:
+				ch.report(CodeSliceParam, node, "cannot pass slice by value, use pointer to slice *%s instead", typ)
+			}
+		}
+	}
+
+	// Body
+	if decl.Body != nil {
+		ch.checkFuncBody(decl.Body)
+		ch.checkEscapes(decl, decl.Body)
+	}
+}
+
+//
+// Expressions
+//
+
+func (ch *checker) isBuiltin(expr ast.Expr, name string) bool {
+	if ident, ok := expr.(*ast.Ident); ok {
+		if builtin, ok := ch.types.Uses[ident].(*types.Builtin); ok {
+			return builtin.Name() == name
+		}
+	}
+	return false
+}
+
+func (ch *checker) checkCompositeLit(lit *ast.CompositeLit) {
+	if len(lit.Elts) > 0 {
+		if _, ok := lit.Elts[0].(*ast.KeyValueExpr); ok {
+			if typ, ok := ch.types.TypeOf(lit).Underlying().(*types.Struct); ok {
+				fieldIndices := make(map[*types.Var]int)
+				for i, nFields := 0, typ.NumFields(); i < nFields; i++ {
+					fieldIndices[typ.Field(i)] = i
+				}
+				lastIndex := 0
+				for _, elt := range lit.Elts {
+					if kv, ok := elt.(*ast.KeyValueExpr); ok {
+						if key, ok := kv.Key.(*ast.Ident); ok {
+							if field, ok := ch.types.ObjectOf(key).(*types.Var); ok {
+								if index := fieldIndices[field]; index < lastIndex {
+									ch.report(CodeFieldOrder, lit, "struct literal fields must appear in definition order")
+									break
+								} else {
+									lastIndex = index
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	for _, elt := range lit.Elts {
+		ch.checkExpr(elt)
+	}
+}
+
+// Builtins with counterparts in the runtime
+var supportedBuiltins = map[string]bool{
+	"append": true, "len": true, "panic": true, "print": true, "println": true, "recover": true,
+}
+
+// checkSelection checks that a selector doesn't use embedded fields, which aren't emitted
+func (ch *checker) checkSelection(expr *ast.SelectorExpr) {
+	if sel := ch.types.Selections[expr]; sel != nil {
+		if len(sel.Index()) > 1 {
+			ch.report(CodeEmbedded, expr.Sel, "promoted fields and methods not supported")
+		} else if field, ok := sel.Obj().(*types.Var); ok && field.Embedded() {
+			ch.report(CodeEmbedded, expr.Sel, "embedded fields not supported")
+		}
+	}
+}
+
+func (ch *checker) checkCallExpr(call *ast.CallExpr) {
+	var builtin *types.Builtin
+	switch fun := call.Fun.(type) {
+	case *ast.Ident:
+		builtin, _ = ch.types.Uses[fun].(*types.Builtin)
+	case *ast.SelectorExpr:
+		builtin, _ = ch.types.Uses[fun.Sel].(*types.Builtin)
+	}
+	if builtin != nil && !supportedBuiltins[builtin.Name()] {
+		ch.report(CodeUnsupportedBuiltin, call.Fun, "builtin function %s not supported", builtin.Name())
+	}
+	if ch.isBuiltin(call.Fun, "panic") && len(call.Args) == 1 {
+		if typ, ok := ch.types.TypeOf(call.Args[0]).Underlying().(*types.Basic); !ok || typ.Info()&types.IsString == 0 {
+			ch.report(CodePanicArg, call.Args[0], "panic argument must be a string")
+		}
+	}
+	if !ch.types.Types[call.Fun].IsType() {
+		switch fun := call.Fun.(type) {
+		case *ast.Ident: // f(x)
+		case *ast.SelectorExpr: // x.f(y) or pkg.f(x)
+			ch.checkSelection(fun)
+			ch.checkExpr(fun.X)
+		case *ast.IndexExpr: // f[T](x)
+		default:
+			ch.checkExpr(fun)
+		}
+	}
+	for _, arg := range call.Args {
+		ch.checkExpr(arg)
+	}
+}
+
+func (ch *checker) checkExpr(expr ast.Expr) {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+	case *ast.BasicLit:
+		switch expr.Kind {
+		case token.INT, token.FLOAT, token.STRING, token.CHAR:
+		default:
+			ch.report(CodeUnsupportedLiteral, expr, "unsupported literal kind")
+		}
+	case *ast.FuncLit:
+		ch.checkFuncBody(expr.Body)
+	case *ast.CompositeLit:
+		ch.checkCompositeLit(expr)
+	case *ast.ParenExpr:
+		ch.checkExpr(expr.X)
+	case *ast.SelectorExpr:
+		if sel := ch.types.Selections[expr]; sel != nil && sel.Kind() != types.FieldVal {
+			ch.report(CodeMethodValue, expr, "method values not supported")
+		}
+		ch.checkSelection(expr)
+		ch.checkExpr(expr.X)
+	case *ast.IndexExpr:
+		ch.checkExpr(expr.X)
+		ch.checkExpr(expr.Index)
+	case *ast.CallExpr:
+		ch.checkCallExpr(expr)
+	case *ast.StarExpr:
+		ch.checkExpr(expr.X)
+	case *ast.UnaryExpr:
+		switch expr.Op {
+		case token.ADD, token.SUB, token.NOT:
+		case token.AND:
+			if !ch.types.Types[expr.X].Addressable() {
+				ch.report(CodeAddressOfTemporary, expr, "cannot take address of a temporary object")
+			}
+		default:
+			ch.report(CodeUnsupportedUnary, expr, "unsupported unary operator")
+		}
+		ch.checkExpr(expr.X)
+	case *ast.BinaryExpr:
+		switch expr.Op {
+		case token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ,
+			token.ADD, token.SUB, token.MUL, token.QUO, token.REM,
+			token.AND, token.OR, token.XOR, token.SHL, token.SHR,
+			token.LAND, token.LOR:
+		default:
+			ch.report(CodeUnsupportedBinary, span{expr.OpPos, expr.OpPos + token.Pos(len(expr.Op.String()))}, "unsupported binary operator")
+		}
+		if typ, ok := ch.types.TypeOf(expr.X).Underlying().(*types.Basic); ok && typ.Info()&types.IsString != 0 && expr.Op == token.ADD {
+			ch.report(CodeUnsupportedBinary, span{expr.OpPos, expr.OpPos + 1}, "string concatenation not supported")
+		}
+		ch.checkExpr(expr.X)
+		ch.checkExpr(expr.Y)
+	case *ast.KeyValueExpr:
+		if _, ok := expr.Key.(*ast.Ident); !ok {
+			ch.report(CodeUnsupportedKey, expr, "unsupported literal key")
+		} else {
+			ch.checkExpr(expr.Value)
+		}
+	default:
+		ch.report(CodeUnsupportedExpr, expr, "unsupported expression type")
+	}
+}
+
+//
+// Statements
+//
+
+func (ch *checker) checkStmt(stmt ast.Stmt) {
+	switch stmt := stmt.(type) {
+	case *ast.ExprStmt:
+		ch.checkExpr(stmt.X)
+	case *ast.IncDecStmt:
+		ch.checkExpr(stmt.X)
+	case *ast.AssignStmt:
+		if len(stmt.Lhs) != 1 {
+			ch.report(CodeMultiAssign, stmt, "multi-value assignment unsupported")
+			return
+		}
+		switch stmt.Tok {
+		case token.DEFINE, token.ASSIGN,
+			token.ADD_ASSIGN, token.SUB_ASSIGN, token.MUL_ASSIGN, token.QUO_ASSIGN, token.REM_ASSIGN,
+			token.AND_ASSIGN, token.OR_ASSIGN, token.XOR_ASSIGN, token.SHL_ASSIGN, token.SHR_ASSIGN:
+		default:
+			ch.report(CodeUnsupportedAssign, span{stmt.TokPos, stmt.TokPos + token.Pos(len(stmt.Tok.String()))}, "unsupported assignment operator")
+		}
+		if ident, ok := stmt.Lhs[0].(*ast.Ident); ok && ident.Name == "_" {
+			ch.report(CodeUnsupportedAssign, ident, "assignment to blank identifier not supported")
+		}
+		ch.checkExpr(stmt.Lhs[0])
+		ch.checkExpr(stmt.Rhs[0])
+	case *ast.ReturnStmt:
+		if len(stmt.Results) > 1 {
+			ch.report(CodeMultipleReturn, span{stmt.Results[0].Pos(), stmt.End()}, "multiple return values not supported")
+		} else if len(stmt.Results) == 1 {
+			ch.checkExpr(stmt.Results[0])
+		}
+	case *ast.BranchStmt:
+		switch stmt.Tok {
+		case token.BREAK, token.CONTINUE:
+		default:
+			ch.report(CodeUnsupportedBranch, span{stmt.TokPos, stmt.End()}, "unsupported branch statement")
+		}
+	case *ast.BlockStmt:
+		ch.checkStmtList(stmt.List)
+	case *ast.IfStmt:
+		if stmt.Init != nil {
+			ch.checkStmt(stmt.Init)
+		}
+		ch.checkExpr(stmt.Cond)
+		ch.checkStmt(stmt.Body)
+		if stmt.Else != nil {
+			ch.checkStmt(stmt.Else)
+		}
+	case *ast.ForStmt:
+		if stmt.Init != nil {
+			ch.checkStmt(stmt.Init)
+		}
+		if stmt.Cond != nil {
+			ch.checkExpr(stmt.Cond)
+		}
+		if stmt.Post != nil {
+			ch.checkStmt(stmt.Post)
+		}
+		ch.checkStmt(stmt.Body)
+	case *ast.RangeStmt:
+		if stmt.Tok == token.ASSIGN {
+			ch.report(CodeRangeDefine, span{stmt.TokPos, stmt.TokPos + token.Pos(len(stmt.Tok.String()))}, "must use := in range statement")
+		}
+		switch typ := ch.types.TypeOf(stmt.X).Underlying().(type) {
+		case *types.Basic:
+			if typ.Info()&types.IsString == 0 {
+				ch.report(CodeUnsupportedStmt, stmt.X, "range over %s not supported", typ)
+			}
+		case *types.Signature:
+			ch.report(CodeUnsupportedStmt, stmt.X, "range over functions not supported")
+		}
+		ch.checkExpr(stmt.X)
+		ch.checkStmtList(stmt.Body.List)
+	case *ast.DeferStmt:
+		if len(stmt.Call.Args) > 0 {
+			ch.report(CodeDeferArgs, span{stmt.Call.Lparen, stmt.Call.End()}, "deferred calls with arguments not supported")
+		} else if lit, ok := stmt.Call.Fun.(*ast.FuncLit); ok {
+			ch.checkFuncBody(lit.Body)
+		} else {
+			ch.checkCallExpr(stmt.Call)
+		}
+	default:
+		ch.report(CodeUnsupportedStmt, stmt, "unsupported statement type")
+	}
+}
+
+func (ch *checker) checkStmtList(list []ast.Stmt) {
+	for _, stmt := range list {
+		ch.checkStmt(stmt)
+	}
+}
+
+// checkFuncBody checks the statements of a function body. Deferred calls run as destructors of
+// guards declared in the outermost block, so they must appear there.
+func (ch *checker) checkFuncBody(body *ast.BlockStmt) {
+	topLevel := make(map[ast.Stmt]bool)
+	for _, stmt := range body.List {
+		topLevel[stmt] = true
+	}
+	ast.Inspect(body, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.DeferStmt:
+			if !topLevel[node] {
+				ch.report(CodeNestedDefer, node, "defer only supported at top level of function body")
+			}
+		}
+		return true
+	})
+	ch.checkStmtList(body.List)
+}
+
+//
+// Escapes
+//
+
+// checkEscapes reports addresses of locals and function literals capturing locals that may
+// outlive the function declaring them, since both refer to storage in its C++ stack frame. The
+// analysis is flow-insensitive: a local that is ever assigned such a value, directly or into one of
+// its fields or elements, is treated as holding it everywhere in the function.
+func (ch *checker) checkEscapes(fn ast.Node, body *ast.BlockStmt) {
+	type escape struct {
+		local  types.Object
+		lambda bool
+	}
+	isLocal := func(obj types.Object) bool {
+		v, ok := obj.(*types.Var)
+		return ok && !v.IsField() && fn.Pos() <= v.Pos() && v.Pos() < fn.End()
+	}
+	holds := make(map[types.Object]escape)
+
+	// Local that an addressable expression refers into, if any
+	var localRoot func(expr ast.Expr) types.Object
+	localRoot = func(expr ast.Expr) types.Object {
+		var x ast.Expr
+		switch expr := expr.(type) {
+		case *ast.Ident:
+			if obj := ch.types.ObjectOf(expr); isLocal(obj) {
+				return obj
+			}
+			return nil
+		case *ast.ParenExpr:
+			return localRoot(expr.X)
+		case *ast.SelectorExpr:
+			x = expr.X
+		case *ast.IndexExpr:
+			x = expr.X
+		case *ast.StarExpr:
+			x = expr.X
+		default:
+			return nil
+		}
+		if _, ok := ch.types.TypeOf(x).(*types.Pointer); ok {
+			if ident, ok := x.(*ast.Ident); ok {
+				if esc, ok := holds[ch.types.ObjectOf(ident)]; ok && !esc.lambda {
+					return esc.local
+				}
+			}
+			return nil
+		}
+		return localRoot(x)
+	}
+
+	// Local whose storage the value of an expression may refer to, if any
+	var escapeOf func(expr ast.Expr) (escape, bool)
+	escapeOf = func(expr ast.Expr) (escape, bool) {
+		switch expr := expr.(type) {
+		case *ast.Ident:
+			esc, ok := holds[ch.types.ObjectOf(expr)]
+			return esc, ok
+		case *ast.ParenExpr:
+			return escapeOf(expr.X)
+		case *ast.UnaryExpr:
+			if expr.Op == token.AND {
+				if local := localRoot(expr.X); local != nil {
+					return escape{local: local}, true
+				}
+			}
+		case *ast.CallExpr:
+			// Conversions are transparent and `append` results hold the appended values. Results of
+			// other calls are assumed not to refer to arguments.
+			if ch.types.Types[expr.Fun].IsType() && len(expr.Args) == 1 {
+				return escapeOf(expr.Args[0])
+			}
+			if ch.isBuiltin(expr.Fun, "append") {
+				for _, arg := range expr.Args {
+					if esc, ok := escapeOf(arg); ok {
+						return esc, ok
+					}
+				}
+			}
+		case *ast.CompositeLit:
+			for _, elt := range expr.Elts {
+				if esc, ok := escapeOf(elt); ok {
+					return esc, ok
+				}
+			}
+		case *ast.KeyValueExpr:
+			return escapeOf(expr.Value)
+		case *ast.FuncLit:
+			var esc escape
+			found := false
+			ast.Inspect(expr.Body, func(node ast.Node) bool {
+				if ident, ok := node.(*ast.Ident); ok && !found {
+					obj := ch.types.Uses[ident]
+					if isLocal(obj) && !(expr.Pos() <= obj.Pos() && obj.Pos() < expr.End()) {
+						esc, found = escape{local: obj, lambda: true}, true
+					}
+				}
+				return !found
+			})
+			return esc, found
+		}
+		return escape{}, false
+	}
+	describe := func(esc escape) string {
+		if esc.lambda {
+			return "function literal capturing local " + esc.local.Name()
+		}
+		return "address of local " + esc.local.Name()
+	}
+
+	// Collect locals holding escaping values until no more are found. A store into a field or
+	// element of a local, or through a pointer to one, makes the local hold the value.
+	for changed := true; changed; {
+		changed = false
+		assign := func(lhs, rhs ast.Expr) {
+			if obj := localRoot(lhs); obj != nil {
+				if _, ok := holds[obj]; !ok {
+					if esc, ok := escapeOf(rhs); ok {
+						holds[obj] = esc
+						changed = true
+					}
+				}
+			}
+		}
+		ast.Inspect(body, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.AssignStmt:
+				if len(node.Lhs) == len(node.Rhs) {
+					for i, lhs := range node.Lhs {
+						assign(lhs, node.Rhs[i])
+					}
+				}
+			case *ast.ValueSpec:
+				if len(node.Names) == len(node.Values) {
+					for i, name := range node.Names {
+						assign(name, node.Values[i])
+					}
+				}
+			}
+			return true
+		})
+	}
+
+	// Check returns and stores outside the function
+	ast.Inspect(body, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.FuncLit:
+			ch.checkEscapes(node, node.Body)
+			return false
+		case *ast.ReturnStmt:
+			for _, result := range node.Results {
+				if esc, ok := escapeOf(result); ok {
+					ch.report(CodeEscape, result, "%s escapes through return", describe(esc))
+				}
+			}
+		case *ast.AssignStmt:
+			if node.Tok == token.ASSIGN && len(node.Lhs) == len(node.Rhs) {
+				for i, lhs := range node.Lhs {
+					if ident, ok := lhs.(*ast.Ident); ok && ident.Name == "_" {
+						continue
+					}
+					if localRoot(lhs) == nil {
+						if esc, ok := escapeOf(node.Rhs[i]); ok {
+							ch.report(CodeEscape, node.Rhs[i], "%s escapes through assignment", describe(esc))
+						}
+					}
+				}
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,12 @@
+package gxcheck
+
+import (
+	"testing"
+
+	"golang.org/x/tools/go/analysis/analysistest"
+)
+
+// TestAnalyzer checks the packages in 'testdata/src' against their '// want' comments
+func TestAnalyzer(t *testing.T) {
+	analysistest.Run(t, analysistest.TestData(), Analyzer, "escapes")
+}
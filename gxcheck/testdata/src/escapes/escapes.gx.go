@@ -0,0 +1,107 @@
+package escapes
+
+type S struct {
+	f *int
+}
+
+var global *int
+
+//
+// Escaping
+//
+
+func returnAddress() *int {
+	x := 0
+	return &x // want `GX0024: address of local x escapes through return`
+}
+
+func returnThroughLocal() *int {
+	x := 0
+	p := &x
+	return p // want `GX0024: address of local x escapes through return`
+}
+
+func returnThroughVar() *int {
+	x := 0
+	var p = &x // want `GX0022: unsupported statement type`
+	return p   // want `GX0024: address of local x escapes through return`
+}
+
+func returnThroughField() S {
+	x := 0
+	s := S{}
+	s.f = &x
+	return s // want `GX0024: address of local x escapes through return`
+}
+
+func returnThroughLiteral() S {
+	x := 0
+	s := S{f: &x}
+	return s // want `GX0024: address of local x escapes through return`
+}
+
+func returnThroughElement() []*int {
+	x := 0
+	ptrs := []*int{nil}
+	ptrs[0] = &x
+	return ptrs // want `GX0024: address of local x escapes through return`
+}
+
+func returnThroughAppend() []*int {
+	x := 0
+	ptrs := []*int{}
+	ptrs = append(ptrs, &x)
+	return ptrs // want `GX0024: address of local x escapes through return`
+}
+
+func storeGlobal() {
+	x := 0
+	global = &x // want `GX0024: address of local x escapes through assignment`
+}
+
+func storeThroughParam(s *S) {
+	x := 0
+	s.f = &x // want `GX0024: address of local x escapes through assignment`
+}
+
+func returnLambda() func() int {
+	x := 0
+	return func() int { // want `GX0024: function literal capturing local x escapes through return`
+		return x
+	}
+}
+
+//
+// Not escaping
+//
+
+func useLocally() int {
+	x := 0
+	p := &x
+	*p = 1
+	s := S{}
+	s.f = &x
+	return *s.f
+}
+
+func returnParamPointer(p *int) *int {
+	return p
+}
+
+func returnGlobalAddress() *int {
+	return global
+}
+
+func returnCopy() int {
+	x := 1
+	var p = &x // want `GX0022: unsupported statement type`
+	return *p
+}
+
+func callLambda() int {
+	x := 0
+	f := func() int {
+		return x
+	}
+	return f()
+}
@@ -3,7 +3,7 @@
 set -e
 
 PLATFORM="macOS"
-CLANG="clang++"
+CXX="clang++"
 GO="go"
 TIME="time"
 TIME_TOTAL="time"
@@ -17,29 +17,31 @@ if [[ -f /proc/version ]]; then
   fi
   if grep -q Microsoft /proc/version; then
     PLATFORM="win"
-    CLANG="clang++.exe"
+    CXX="clang++.exe"
     GO="go.exe"
     EXE=".exe"
   fi
 fi
-CLANG="$TIME $CLANG"
 GO="$TIME $GO"
 
 case "$1" in
   # Desktop
   release)
-    mkdir -p build
-    $GO build gx.go
-    rm -rf build/example.gx.*
-    $TIME ./gx$EXE ./example build/example
+    $GO build -o gx$EXE ./cmd/gx
+    $TIME ./gx$EXE run -v -O 3 -compile-commands -cxx $CXX ./example build/example || true
     rm gx$EXE
-    if [[ -f build/example.gx.cc ]]; then
-      $CLANG -std=c++20 -Wall -O3 -Iexample -o output build/example.gx.cc || true
-    fi
-    if [[ -f output ]]; then
-      ./output || true
-      rm output
-    fi
     exit 1
     ;;
+
+  # Tests
+  test)
+    $GO build -o gx$EXE ./cmd/gx
+    $TIME ./gx$EXE test -cxx $CXX ./example/foo build/foo.test
+    rm gx$EXE
+    ;;
+
+  # Differential tests against the Go toolchain
+  diff)
+    $GO run ./cmd/gxdiff -cxx $CXX ./example ./testdata/diff/...
+    ;;
 esac
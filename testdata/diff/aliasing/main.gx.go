@@ -0,0 +1,62 @@
+package main
+
+type Big struct {
+	a, b, c, d, e int
+}
+
+func set(l Big, p *Big) int {
+	p.a = 100
+	return l.a
+}
+
+type Item struct {
+	name  string
+	value int
+}
+
+type World struct {
+	items []Item
+}
+
+func grow(item Item, w *World) int {
+	for i := 0; i < 64; i++ {
+		w.items = append(w.items, Item{"filler", i})
+	}
+	return item.value + len(item.name)
+}
+
+var counter Big
+
+func bump() {
+	counter.a++
+}
+
+func readAfterBump(l Big) int {
+	bump()
+	return l.a
+}
+
+func sum(l Big) int {
+	return l.a + l.b + l.c + l.d + l.e
+}
+
+func main() {
+	x := Big{1, 2, 3, 4, 5}
+	r := set(x, &x)
+	println(r)
+	println(x.a)
+
+	w := World{}
+	w.items = append(w.items, Item{"first", 7})
+	r = grow(w.items[0], &w)
+	println(r)
+	println(len(w.items))
+
+	counter = Big{1, 2, 3, 4, 5}
+	r = readAfterBump(counter)
+	println(r)
+	println(counter.a)
+
+	r = sum(x)
+	println(r)
+}
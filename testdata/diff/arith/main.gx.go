@@ -0,0 +1,49 @@
+package main
+
+func main() {
+	a := 17
+	b := 5
+	println(a + b)
+	println(a - b)
+	println(a * b)
+	println(a / b)
+	println(a % b)
+	println(-a / b)
+	println(-a % b)
+	println(a / -b)
+	println(a % -b)
+	println(a << 3)
+	println(a >> 2)
+	println(-a >> 2)
+	println(a & b)
+	println(a | b)
+	println(a ^ b)
+	println(a + b*2 - (a-b)/3)
+	println(a > b && b > 0)
+	println(a < b || b < 0)
+	println(!(a == b))
+
+	x := 3
+	x += 4
+	x *= 5
+	x -= 6
+	x /= 2
+	x %= 7
+	x <<= 4
+	x >>= 1
+	x |= 3
+	x &= 26
+	x ^= 9
+	println(x)
+	x++
+	x++
+	x--
+	println(x)
+
+	f := float32(7) / 2
+	println(f == 3.5)
+	println(int(f))
+	println(int(-f))
+	d := 2.75
+	println(int(d * 4))
+}
@@ -0,0 +1,43 @@
+package main
+
+func apply(n int, f func(int) int) int {
+	return f(n)
+}
+
+func repeat(n int, f func()) {
+	for i := 0; i < n; i++ {
+		f()
+	}
+}
+
+func main() {
+	counter := 0
+	incr := func() {
+		counter++
+	}
+	incr()
+	repeat(4, incr)
+	println(counter)
+
+	k := 3
+	println(apply(5, func(x int) int {
+		return x * k
+	}))
+	k = 10
+	println(apply(5, func(x int) int {
+		return x * k
+	}))
+
+	square := func(x int) int {
+		return x * x
+	}
+	println(apply(7, square))
+
+	total := 0
+	repeat(3, func() {
+		repeat(2, func() {
+			total += 5
+		})
+	})
+	println(total)
+}
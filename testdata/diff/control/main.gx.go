@@ -0,0 +1,66 @@
+package main
+
+func collatz(n int) int {
+	steps := 0
+	for n != 1 {
+		if n%2 == 0 {
+			n /= 2
+		} else {
+			n = 3*n + 1
+		}
+		steps++
+	}
+	return steps
+}
+
+func classify(n int) string {
+	if n < 0 {
+		return "negative"
+	} else if n == 0 {
+		return "zero"
+	} else if n < 10 {
+		return "small"
+	}
+	return "large"
+}
+
+func main() {
+	println(collatz(27))
+	for _, n := range []int{-4, 0, 7, 12} {
+		println(classify(n))
+	}
+
+	sum := 0
+	for i := 0; i < 20; i++ {
+		if i%3 == 0 {
+			continue
+		}
+		if i > 15 {
+			break
+		}
+		sum += i
+	}
+	println(sum)
+
+	count := 0
+	for {
+		count++
+		if count*count > 50 {
+			break
+		}
+	}
+	println(count)
+
+	if x := collatz(6); x > 5 {
+		println(x)
+	}
+
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			if j > i {
+				break
+			}
+			println(i*10 + j)
+		}
+	}
+}
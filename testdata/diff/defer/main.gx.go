@@ -0,0 +1,38 @@
+package main
+
+func order() {
+	defer func() {
+		println("first deferred, runs last")
+	}()
+	defer func() {
+		println("second deferred, runs first")
+	}()
+	println("body")
+}
+
+func modify(val *int) int {
+	defer func() {
+		*val *= 10
+	}()
+	*val += 1
+	return *val
+}
+
+func loop() {
+	for i := 0; i < 3; i++ {
+		func() {
+			defer func() {
+				println(i)
+			}()
+			println(100 + i)
+		}()
+	}
+}
+
+func main() {
+	order()
+	val := 4
+	println(modify(&val))
+	println(val)
+	loop()
+}
@@ -0,0 +1,64 @@
+package main
+
+type Number interface {
+	int | float32
+}
+
+func Sum[T Number](s *[]T) T {
+	total := T(0)
+	for _, v := range *s {
+		total += v
+	}
+	return total
+}
+
+func Max[T Number](a, b T) T {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+type Stack[T any] struct {
+	items []T
+}
+
+func (s *Stack[T]) Push(v T) {
+	s.items = append(s.items, v)
+}
+
+func (s *Stack[T]) Len() int {
+	return len(s.items)
+}
+
+func (s *Stack[T]) Top() T {
+	return s.items[len(s.items)-1]
+}
+
+type Pair[A any, B any] struct {
+	First  A
+	Second B
+}
+
+func main() {
+	ints := []int{1, 2, 3, 4}
+	println(Sum(&ints))
+	floats := []float32{0.5, 1.5}
+	println(Sum(&floats) == 2)
+	println(Max(3, 7))
+	println(Max[float32](2.5, 1) == 2.5)
+
+	s := Stack[int]{}
+	s.Push(10)
+	s.Push(20)
+	println(s.Len())
+	println(s.Top())
+
+	pairs := Stack[Pair[int, int]]{}
+	pairs.Push(Pair[int, int]{1, 2})
+	println(pairs.Top().Second)
+
+	p := Pair[int, string]{3, "three"}
+	println(p.First)
+	println(p.Second)
+}
@@ -0,0 +1,14 @@
+package main
+
+func check(n int) {
+	if n > 2 {
+		panic("n is too large")
+	}
+	println(n)
+}
+
+func main() {
+	for i := 0; i < 5; i++ {
+		check(i)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+type Node struct {
+	val  int
+	next *Node
+}
+
+func main() {
+	n := Node{val: 1}
+	println(n.val)
+	if n.next == nil {
+		println("nil next")
+	}
+	println(n.next.val)
+	println("unreachable")
+}
@@ -0,0 +1,44 @@
+package main
+
+func safeGet(s *[]int, i int) (value int) {
+	defer func() {
+		if recover() != nil {
+			value = -1
+		}
+	}()
+	return (*s)[i]
+}
+
+func twice(x int) (result int) {
+	defer func() {
+		result *= 2
+	}()
+	return x + 1
+}
+
+func count() (n int) {
+	n = 5
+	return
+}
+
+func replaced() (code int) {
+	defer func() {
+		if recover() != nil {
+			code = 2
+		}
+	}()
+	defer func() {
+		panic("second")
+	}()
+	code = 1
+	panic("first")
+}
+
+func main() {
+	s := []int{1, 2, 3}
+	println(safeGet(&s, 1))
+	println(safeGet(&s, 5))
+	println(twice(4))
+	println(count())
+	println(replaced())
+}
@@ -0,0 +1,57 @@
+package main
+
+type Point struct {
+	X, Y int
+}
+
+func appendSquares(s *[]int, n int) {
+	for i := 0; i < n; i++ {
+		*s = append(*s, i*i)
+	}
+}
+
+func sum(s *[]int) int {
+	total := 0
+	for _, v := range *s {
+		total += v
+	}
+	return total
+}
+
+func main() {
+	s := []int{}
+	println(len(s))
+	appendSquares(&s, 10)
+	println(len(s))
+	println(sum(&s))
+	println(s[9])
+
+	nested := [][]int{{1, 2}, {}, {3}}
+	nested[1] = append(nested[1], 7)
+	for i, inner := range nested {
+		for j, v := range inner {
+			println(i*100 + j*10 + v)
+		}
+	}
+
+	points := []Point{{1, 2}, {X: 3}, {Y: 4}}
+	points = append(points, Point{5, 6})
+	for i := range points {
+		points[i].X *= 2
+	}
+	for _, p := range points {
+		println(p.X + p.Y)
+	}
+
+	arr := [4]int{1, 2, 3}
+	copied := arr
+	copied[0] = 9
+	println(arr[0])
+	println(copied[0])
+	println(len(arr))
+	total := 0
+	for _, v := range arr {
+		total += v
+	}
+	println(total)
+}
@@ -0,0 +1,48 @@
+package main
+
+type Named struct {
+	name string
+}
+
+func countByte(s string, b byte) int {
+	count := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == b {
+			count++
+		}
+	}
+	return count
+}
+
+func main() {
+	s := "hello, world"
+	println(s)
+	println(len(s))
+	println(countByte(s, 'o'))
+	println(int(s[4]))
+	println(s == "hello, world")
+	println(s != "hello")
+
+	empty := ""
+	println(len(empty))
+	println(empty == "")
+
+	n := Named{"gx"}
+	copied := n
+	println(copied.name)
+	println(len(n.name))
+
+	sum := 0
+	for i, c := range "abc" {
+		sum += i * int(c)
+	}
+	println(sum)
+
+	names := []string{"a", "bb", "ccc"}
+	total := 0
+	for _, name := range names {
+		total += len(name)
+	}
+	println(total)
+	println(names[2])
+}
@@ -0,0 +1,65 @@
+package main
+
+type Vec struct {
+	X, Y int
+}
+
+func (v Vec) Add(o Vec) Vec {
+	return Vec{v.X + o.X, v.Y + o.Y}
+}
+
+func (v *Vec) Scale(k int) {
+	v.X *= k
+	v.Y *= k
+}
+
+func (v Vec) Dot(o Vec) int {
+	return v.X*o.X + v.Y*o.Y
+}
+
+type Body struct {
+	pos, vel Vec
+	mass     int
+}
+
+func (b *Body) Step() {
+	b.pos = b.pos.Add(b.vel)
+}
+
+func move(b Body) {
+	b.Step()
+}
+
+func main() {
+	v := Vec{1, 2}
+	w := Vec{X: 3, Y: 4}
+	println(v.Add(w).X)
+	println(v.Add(w).Y)
+	println(v.Dot(w))
+	v.Scale(3)
+	println(v.X)
+	println(v.Y)
+
+	p := &w
+	p.Scale(2)
+	println(w.X)
+	println(p.Dot(v))
+
+	b := Body{vel: Vec{1, -1}, mass: 5}
+	for i := 0; i < 3; i++ {
+		b.Step()
+	}
+	println(b.pos.X)
+	println(b.pos.Y)
+	move(b)
+	println(b.pos.X)
+
+	c := b
+	c.mass = 7
+	println(b.mass)
+	println(c.mass)
+
+	q := &b.pos
+	q.X = 42
+	println(b.pos.X)
+}
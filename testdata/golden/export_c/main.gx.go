@@ -0,0 +1,73 @@
+package main
+
+type Vec2 struct {
+	X, Y float32
+}
+
+type Body struct {
+	Pos, Vel Vec2
+}
+
+var bodies []Body
+
+//gx:export_c gx_add_body
+func addBody(pos Vec2) *Body {
+	bodies = append(bodies, Body{Pos: pos})
+	return &bodies[len(bodies)-1]
+}
+
+type Rect struct {
+	Min, Max Vec2
+	Weights  [2]int
+	Owner    *Body
+	Visible  bool
+}
+
+//gx:export_c gx_rect_area
+func rectArea(r Rect) float32 {
+	if !r.Visible {
+		return 0
+	}
+	return (r.Max.X - r.Min.X) * (r.Max.Y - r.Min.Y)
+}
+
+//gx:export_c gx_step
+func step(dt float32) int {
+	for i := range bodies {
+		bodies[i].Pos.X += bodies[i].Vel.X * dt
+		bodies[i].Pos.Y += bodies[i].Vel.Y * dt
+	}
+	return len(bodies)
+}
+
+//gx:export_c gx_position
+func position(body *Body) Vec2 {
+	return body.Pos
+}
+
+//gx:export_c gx_greet
+func greet(name string) string {
+	if name == "" {
+		return "hello"
+	}
+	return "hello, friend"
+}
+
+//gx:export_c gx_double_all
+func doubleAll(values *[]int) {
+	for i := range *values {
+		(*values)[i] *= 2
+	}
+}
+
+//gx:export_c gx_counts
+func counts(n int) []int {
+	result := []int{}
+	for i := 0; i < n; i++ {
+		result = append(result, i)
+	}
+	return result
+}
+
+func main() {
+}
@@ -0,0 +1,48 @@
+package main
+
+type Vec2 struct {
+	X, Y float32
+}
+
+type Player struct {
+	Pos   Vec2
+	Speed float32
+}
+
+type Game struct {
+	players []Player
+}
+
+func (g *Game) count() int {
+	return len(g.players)
+}
+
+//gx:export
+const MaxPlayers = 4
+
+//gx:export
+var game Game
+
+// Score isn't exported, so it's only defined in the '.cc'
+var score = 0
+
+//gx:export
+func AddPlayer(x, y float32) *Player {
+	game.players = append(game.players, Player{Pos: Vec2{x, y}, Speed: 1})
+	return &game.players[len(game.players)-1]
+}
+
+//gx:export
+func UpdateGame(dt float32) {
+	for i := range game.players {
+		game.players[i].Pos.X += game.players[i].Speed * dt
+	}
+	score++
+}
+
+func main() {
+	AddPlayer(0, 0)
+	UpdateGame(0.5)
+	println(game.count())
+	println(score)
+}
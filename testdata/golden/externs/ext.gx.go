@@ -0,0 +1,21 @@
+//gx:include "ext.hh"
+//gx:externs ext::
+
+package main
+
+type Handle struct {
+	ID    int
+	Owner int //gx:extern ownerId
+}
+
+func NewHandle(id int) Handle
+
+func (h Handle) Valid() bool
+
+//gx:extern ext::release
+func (h *Handle) Release()
+
+//gx:extern ext::Flags
+type Flags int
+
+var Count int
@@ -0,0 +1,29 @@
+#pragma once
+
+#define MAX_HANDLES 16
+
+namespace ext {
+
+struct Handle {
+  int id;
+  int ownerId;
+};
+
+using Flags = int;
+
+inline int Count = 0;
+
+inline Handle NewHandle(int id) {
+  ++Count;
+  return { id, 0 };
+}
+
+inline bool Valid(Handle h) {
+  return h.id != 0;
+}
+
+inline void release(Handle *h) {
+  h->id = 0;
+}
+
+}
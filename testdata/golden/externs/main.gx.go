@@ -0,0 +1,24 @@
+//gx:include <cmath>
+
+package main
+
+//gx:extern std::sqrt
+func sqrt(x float32) float32
+
+//gx:extern MAX_HANDLES
+const maxHandles = 0
+
+type Wrapper struct {
+	handle Handle
+	flags  Flags
+}
+
+func main() {
+	w := Wrapper{handle: NewHandle(maxHandles)}
+	if w.handle.Valid() {
+		println(w.handle.Owner)
+		w.handle.Release()
+	}
+	println(Count)
+	println(sqrt(4) == 2)
+}
@@ -0,0 +1,45 @@
+package main
+
+type Numeric interface {
+	int | float32
+}
+
+type Pair[A any, B any] struct {
+	first  A
+	second B
+}
+
+type List[T any] struct {
+	items []T
+}
+
+func (l *List[T]) push(item T) {
+	l.items = append(l.items, item)
+}
+
+func (l *List[T]) len() int {
+	return len(l.items)
+}
+
+func sum[T Numeric](list *List[T]) T {
+	total := T(0)
+	for _, item := range list.items {
+		total += item
+	}
+	return total
+}
+
+func swap[A any, B any](p Pair[A, B]) Pair[B, A] {
+	return Pair[B, A]{p.second, p.first}
+}
+
+func main() {
+	list := List[int]{}
+	list.push(1)
+	list.push(2)
+	println(sum(&list))
+	println(sum[int](&list))
+	println(list.len())
+	p := swap(Pair[int, float32]{1, 2})
+	println(p.second)
+}
@@ -0,0 +1,44 @@
+package main
+
+type Behavior struct{}
+
+type Position struct {
+	Behavior
+
+	X, Y float32
+}
+
+type Health struct {
+	Behavior
+
+	Value int     `default:"100"`
+	Max   int     `default:"100" attribs:"clamp"`
+	Regen float32 `attribs:"hidden"`
+}
+
+type Color struct {
+	R, G, B byte
+	A       byte `default:"255"`
+}
+
+type Sprite struct {
+	Behavior
+
+	tint   Color
+	layers []int
+}
+
+func (h *Health) heal(amount int) {
+	h.Value += amount
+	if h.Value > h.Max {
+		h.Value = h.Max
+	}
+}
+
+func main() {
+	h := Health{}
+	h.heal(10)
+	println(h.Value)
+	s := Sprite{}
+	println(int(s.tint.A))
+}
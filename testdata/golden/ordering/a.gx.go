@@ -0,0 +1,12 @@
+// This file appears first in AST order but refers to declarations in 'b.gx.go', which should be
+// hoisted before their uses in the output.
+
+package main
+
+type Line struct {
+	from, to Point
+}
+
+var origin = makePoint(zero, zero)
+
+var unit = Line{origin, Point{one, one}}
@@ -0,0 +1,29 @@
+package main
+
+type Point struct {
+	x, y int
+}
+
+type Shape struct {
+	lines []Line
+}
+
+const zero = 0
+
+const one = zero + 1
+
+func makePoint(x, y int) Point {
+	return Point{x, y}
+}
+
+func (l Line) length2() int {
+	dx := l.to.x - l.from.x
+	dy := l.to.y - l.from.y
+	return dx*dx + dy*dy
+}
+
+func main() {
+	s := Shape{}
+	s.lines = append(s.lines, unit)
+	println(s.lines[0].length2())
+}
@@ -0,0 +1,32 @@
+package main
+
+// A recovering deferred call assigns the named result, which is returned after the panic
+func safeGet(s *[]int, i int) (value int) {
+	defer func() {
+		if recover() != nil {
+			value = -1
+		}
+	}()
+	return (*s)[i]
+}
+
+// Deferred calls run after 'return' assigns the named result
+func twice(x int) (result int) {
+	defer func() {
+		result *= 2
+	}()
+	return x + 1
+}
+
+// Without deferred calls, a bare 'return' returns the named result
+func count() (n int) {
+	n = 5
+	return
+}
+
+func main() {
+	s := []int{1, 2, 3}
+	println(safeGet(&s, 5))
+	println(twice(4))
+	println(count())
+}
@@ -0,0 +1,69 @@
+package main
+
+type Shape interface {
+	area() int
+}
+
+type Square struct {
+	side int
+}
+
+func (s Square) area() int {
+	return s.side * s.side
+}
+
+func (s Square) perimeter() int { // Removed: never called
+	return 4 * s.side
+}
+
+type Box[T any] struct {
+	item T
+}
+
+func (b *Box[T]) get() T {
+	return b.item
+}
+
+func (b *Box[T]) set(item T) { // Removed: never called on any instance
+	b.item = item
+}
+
+type Unused struct { // Removed: only used by a removed function
+	x int
+}
+
+func unused() Unused {
+	return Unused{x: helper()}
+}
+
+func helper() int { // Removed: only called by a removed function
+	return 1
+}
+
+var counter = 0                      // Removed: never referenced
+var registered = registerName("box") // Kept: initializer may have side effects
+
+func registerName(name string) bool {
+	println(name)
+	return true
+}
+
+func totalArea[S Shape](shapes *[]S) int {
+	total := 0
+	for _, shape := range *shapes {
+		total += shape.area()
+	}
+	return total
+}
+
+//gx:export
+func exported() int { // Kept: marked for export
+	return 2
+}
+
+func main() {
+	squares := []Square{{2}, {3}}
+	println(totalArea(&squares))
+	box := Box[int]{3}
+	println(box.get())
+}
@@ -0,0 +1,5 @@
+package panics
+
+func At(s *[]int, i int) int {
+	return (*s)[i]
+}
@@ -0,0 +1,15 @@
+package panics
+
+import "github.com/nikki93/gx/testing"
+
+func TestPanics(t *testing.T) {
+	s := []int{1, 2}
+	At(&s, 2)
+}
+
+func TestAfterPanic(t *testing.T) {
+	s := []int{1, 2}
+	if got := At(&s, 1); got != 2 {
+		t.Errorf("At(&s, 1) = %d, want 2", got)
+	}
+}
@@ -0,0 +1,390 @@
+#pragma once
+
+#include <chrono>
+#include <cstdarg>
+#include <cstdio>
+#include <cstdlib>
+#include <cstring>
+#include <initializer_list>
+#include <regex>
+#include <string>
+#include <type_traits>
+
+#ifndef __cpp_exceptions
+#error "gx tests need C++ exceptions, which `t.FailNow` and `t.Fatalf` use to stop a test"
+#endif
+
+
+namespace gx::testing {
+
+
+//
+// Buffer
+//
+
+struct Buffer {
+  char *data = nullptr;
+  int size = 0;
+  int capacity = 0;
+
+  Buffer() = default;
+  Buffer(const Buffer &) = delete;
+  Buffer &operator=(const Buffer &) = delete;
+
+  ~Buffer() {
+    std::free(data);
+  }
+
+  void write(const char *s, int n) {
+    if (size + n + 1 > capacity) {
+      capacity = 2 * (size + n + 1);
+      data = (char *)std::realloc(data, capacity);
+    }
+    std::memcpy(&data[size], s, n);
+    size += n;
+    data[size] = '\0';
+  }
+
+  void write(const char *s) {
+    write(s, int(std::strlen(s)));
+  }
+
+  void printf(const char *format, ...) {
+    char buf[512];
+    va_list args;
+    va_start(args, format);
+    int n = std::vsnprintf(buf, sizeof(buf), format, args);
+    va_end(args);
+    write(buf, n < int(sizeof(buf)) ? n : int(sizeof(buf)) - 1);
+  }
+
+  // Writes `s` with each line prefixed by `indent`
+  void writeIndented(const char *s, const char *indent) {
+    bool lineStart = true;
+    for (const char *c = s; *c; ++c) {
+      if (lineStart) {
+        write(indent);
+      }
+      write(c, 1);
+      lineStart = *c == '\n';
+    }
+  }
+
+  const char *c_str() const {
+    return data ? data : "";
+  }
+};
+
+
+//
+// Format
+//
+
+// Formats an argument with a Go verb. `spec` holds the flags, width and precision between '%' and
+// the verb, so they can be passed on to printf.
+template<typename A>
+void formatArg(Buffer &out, const char *spec, char verb, const A &arg) {
+  char format[32];
+  auto printfVerb = [&](const char *conv, auto val) {
+    std::snprintf(format, sizeof(format), "%%%s%s", spec, conv);
+    out.printf(format, val);
+  };
+  using D = std::decay_t<A>;
+  if constexpr (std::is_same_v<D, bool>) {
+    if (verb == 'v' || verb == 't') {
+      printfVerb("s", arg ? "true" : "false");
+      return;
+    }
+  } else if constexpr (std::is_integral_v<D>) {
+    switch (verb) {
+    case 'v':
+    case 'd':
+      return printfVerb("lld", (long long)arg);
+    case 'x':
+      return printfVerb("llx", (long long)arg);
+    case 'X':
+      return printfVerb("llX", (long long)arg);
+    case 'o':
+      return printfVerb("llo", (long long)arg);
+    case 'c':
+      return printfVerb("c", int(arg));
+    case 'q': {
+      char quoted[] = { '\'', char(arg), '\'', '\0' };
+      return printfVerb("s", quoted);
+    }
+    }
+  } else if constexpr (std::is_floating_point_v<D>) {
+    switch (verb) {
+    case 'v':
+      return printfVerb("g", double(arg));
+    case 'f':
+    case 'F':
+    case 'g':
+    case 'G':
+    case 'e':
+    case 'E': {
+      char conv[] = { verb, '\0' };
+      return printfVerb(conv, double(arg));
+    }
+    }
+  } else if constexpr (std::is_convertible_v<const A &, const char *>) {
+    const char *s = arg;
+    switch (verb) {
+    case 'v':
+    case 's':
+      return printfVerb("s", s);
+    case 'q':
+      out.write("\"");
+      out.write(s);
+      out.write("\"");
+      return;
+    }
+  } else if constexpr (std::is_pointer_v<D>) {
+    if (verb == 'v' || verb == 'p') {
+      return printfVerb("p", (const void *)arg);
+    }
+  } else {
+    out.write("%!");
+    out.write(&verb, 1);
+    out.write("(unsupported)");
+    return;
+  }
+  out.write("%!");
+  out.write(&verb, 1);
+  out.write("(bad verb)");
+}
+
+// Writes the text of `format` up to its next verb, returning a pointer past the verb or to the end
+inline const char *formatNextVerb(Buffer &out, const char *format, char *spec, char *verb) {
+  while (*format) {
+    if (format[0] != '%') {
+      out.write(format, 1);
+      ++format;
+      continue;
+    }
+    if (format[1] == '%') {
+      out.write("%");
+      format += 2;
+      continue;
+    }
+    ++format;
+    int n = 0;
+    while (*format && std::strchr("+-# 0123456789.", *format) && n < 15) {
+      spec[n++] = *format++;
+    }
+    spec[n] = '\0';
+    *verb = *format ? *format++ : 'v';
+    return format;
+  }
+  *verb = '\0';
+  return format;
+}
+
+inline void formatRest(Buffer &out, const char *format) {
+  char spec[16], verb;
+  while (format = formatNextVerb(out, format, spec, &verb), verb) {
+    out.write("%!");
+    out.write(&verb, 1);
+    out.write("(MISSING)");
+  }
+}
+
+// Formats arguments like Go's `fmt.Sprintf`
+template<typename A, typename... Args>
+void formatRest(Buffer &out, const char *format, const A &arg, const Args &...args) {
+  char spec[16], verb;
+  format = formatNextVerb(out, format, spec, &verb);
+  if (!verb) {
+    out.write("%!(EXTRA)");
+    return;
+  }
+  formatArg(out, spec, verb, arg);
+  formatRest(out, format, args...);
+}
+
+template<typename... Args>
+void format(Buffer &out, const char *format, const Args &...args) {
+  formatRest(out, format, args...);
+}
+
+
+//
+// T
+//
+
+struct Filter {
+  const char *pattern = "";
+  bool verbose = false;
+};
+
+inline Filter filter;
+
+struct T {
+  Buffer name;
+  int depth = 0;
+  bool failed = false;
+  Buffer output; // Messages and subtest results, printed after this test's result
+};
+
+// Thrown by `FailNow` to stop a test, unwinding its locals
+struct FailNowSignal {};
+
+// Set to `gx::caughtPanic` by test runners built with `-recover`, so that a panicking test fails and
+// the remaining tests still run
+inline bool (*caughtPanic)(const char **msg, const char **pos) = nullptr;
+
+template<typename... Args>
+void Logf(T *t, const char *format_, const Args &...args) {
+  Buffer message;
+  format(message, format_, args...);
+  t->output.writeIndented(message.c_str(), "    ");
+  if (message.size == 0 || message.data[message.size - 1] != '\n') {
+    t->output.write("\n");
+  }
+}
+
+inline void Fail(T *t) {
+  t->failed = true;
+}
+
+inline bool Failed(T *t) {
+  return t->failed;
+}
+
+inline const char *Name(T *t) {
+  return t->name.c_str();
+}
+
+[[noreturn]] inline void FailNow(T *t) {
+  t->failed = true;
+  throw FailNowSignal {};
+}
+
+template<typename... Args>
+void Errorf(T *t, const char *format_, const Args &...args) {
+  Logf(t, format_, args...);
+  Fail(t);
+}
+
+template<typename... Args>
+[[noreturn]] void Fatalf(T *t, const char *format_, const Args &...args) {
+  Logf(t, format_, args...);
+  FailNow(t);
+}
+
+// Whether a test name matches the corresponding element of the slash-separated `-run` pattern.
+// Patterns are ECMAScript regular expressions, which agree with Go's for typical patterns.
+inline bool matchesFilter(const char *name, int depth) {
+  const char *element = filter.pattern;
+  for (int i = 0; i < depth && element; ++i) {
+    element = std::strchr(element, '/');
+    if (element) {
+      ++element;
+    }
+  }
+  if (!element || !*element) {
+    return true;
+  }
+  const char *end = std::strchr(element, '/');
+  std::string elementPattern(element, end ? end - element : std::strlen(element));
+  const char *base = std::strrchr(name, '/');
+  return std::regex_search(base ? base + 1 : name, std::regex(elementPattern));
+}
+
+template<typename F>
+void runTest(T &t, F &&f) {
+  if (filter.verbose) {
+    std::printf("=== RUN   %s\n", t.name.c_str());
+  }
+  auto start = std::chrono::steady_clock::now();
+  try {
+    f(&t);
+  } catch (FailNowSignal) {
+  } catch (...) {
+    const char *msg, *pos;
+    if (!caughtPanic || !caughtPanic(&msg, &pos)) {
+      throw;
+    }
+    t.failed = true;
+    Buffer message;
+    message.printf("panic: %s\n", msg);
+    if (pos) {
+      message.printf("\t%s\n", pos);
+    }
+    t.output.writeIndented(message.c_str(), "    ");
+  }
+  std::chrono::duration<double> elapsed = std::chrono::steady_clock::now() - start;
+  Buffer result;
+  if (t.failed) {
+    result.printf("--- FAIL: %s (%.2fs)\n", t.name.c_str(), elapsed.count());
+  } else if (filter.verbose) {
+    result.printf("--- PASS: %s (%.2fs)\n", t.name.c_str(), elapsed.count());
+  }
+  if (t.failed || filter.verbose) {
+    result.write(t.output.c_str());
+  }
+  t.output.size = 0;
+  t.output.write(result.c_str());
+}
+
+// Runs `f` as a subtest of `t` named `name`, returning whether it passed
+template<typename F>
+bool Run(T *t, const char *name, F &&f) {
+  T sub;
+  sub.name.write(t->name.c_str());
+  sub.name.write("/");
+  for (const char *c = name; *c; ++c) {
+    sub.name.write(*c == ' ' ? "_" : c, 1);
+  }
+  sub.depth = t->depth + 1;
+  if (!matchesFilter(sub.name.c_str(), sub.depth)) {
+    return true;
+  }
+  runTest(sub, f);
+  t->output.writeIndented(sub.output.c_str(), "    ");
+  if (sub.failed) {
+    t->failed = true;
+  }
+  return !sub.failed;
+}
+
+
+//
+// Runner
+//
+
+struct Test {
+  const char *name;
+  void (*fn)(T *t);
+};
+
+// Runs tests matching `-run`, printing results like `go test` and returning the exit code
+inline int runTests(int argc, char **argv, std::initializer_list<Test> tests) {
+  for (int i = 1; i < argc; ++i) {
+    if (!std::strcmp(argv[i], "-v") || !std::strcmp(argv[i], "-test.v")) {
+      filter.verbose = true;
+    } else if ((!std::strcmp(argv[i], "-run") || !std::strcmp(argv[i], "-test.run")) && i + 1 < argc) {
+      filter.pattern = argv[++i];
+    } else {
+      std::fprintf(stderr, "usage: %s [-v] [-run regexp]\n", argv[0]);
+      return 2;
+    }
+  }
+  bool failed = false;
+  for (auto &test : tests) {
+    T t;
+    t.name.write(test.name);
+    if (!matchesFilter(t.name.c_str(), 0)) {
+      continue;
+    }
+    runTest(t, test.fn);
+    std::fputs(t.output.c_str(), stdout);
+    std::fflush(stdout);
+    failed = failed || t.failed;
+  }
+  std::puts(failed ? "FAIL" : "PASS");
+  return failed ? 1 : 0;
+}
+
+
+}
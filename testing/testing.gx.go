@@ -0,0 +1,25 @@
+//gx:include "gx_testing.hh"
+//gx:externs gx::testing::
+
+// Package testing is a minimal version of Go's testing package for tests run by 'gx test'. Messages
+// are formatted with the %v, %d, %s, %q, %x, %c, %t, %f, %g and %e verbs. Tests need C++
+// exceptions, which FailNow and Fatalf use to stop a test.
+package testing
+
+type T struct{}
+
+func (t *T) Logf(format string, args ...any)
+
+func (t *T) Errorf(format string, args ...any)
+
+func (t *T) Fatalf(format string, args ...any)
+
+func (t *T) Fail()
+
+func (t *T) FailNow()
+
+func (t *T) Failed() bool
+
+func (t *T) Name() string
+
+func (t *T) Run(name string, f func(t *T)) bool